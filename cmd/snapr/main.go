@@ -7,6 +7,9 @@ import (
 	"os"
 	"os/signal"
 	"snapr/internal/snapr"
+	"sort"
+	"strconv"
+	"strings"
 	"syscall"
 
 	"github.com/rs/zerolog"
@@ -17,67 +20,220 @@ import (
 var configuration string
 var fileSystem string
 var debug bool
+var dryRun bool
+
+// Exit codes distinguish a run in which some file systems or destinations failed from one in which all failed.
+const (
+	exitError   = 1
+	exitPartial = 2
+	exitFailed  = 3
+)
 
 var snap = &snapr.SnapArguments{}
 var send = &snapr.SendArguments{}
+var prune = &snapr.PruneArguments{}
 var restore = &snapr.RestoreArguments{}
+var daemon = &snapr.DaemonArguments{}
+var status = &snapr.StatusArguments{}
 
 func init() {
 	flag.BoolVar(&snap.Active, "snap", false, "Creates snapshots based on the configured file systems and intervals")
 	flag.BoolVar(&send.Active, "send", false, "Sends new snapshots to the configured destinations")
+	flag.BoolVar(&prune.Active, "prune", false, "Destroys expired snapshots based on the configured retention")
 	flag.BoolVar(&restore.Active, "restore", false, "Restores a file system from a bucket")
+	flag.StringVar(&restore.Target, "target", "", "Restores into a different file system or pool")
+	flag.StringVar(&restore.Destination, "destination", "", "Restores from the send entry with the given name or index (the last by default)")
+	flag.BoolVar(&restore.Fallback, "fallback", false, "Restores from another send entry if the destination is incomplete or fails")
+	restore.Receive.Properties = make(map[string]string)
+	flag.Var(properties(restore.Receive.Properties), "property", "Sets a property on the restored file system (name=value, repeatable)")
+	flag.Var((*list)(&restore.Receive.Exclude), "exclude-property", "Excludes a property from the restored file system (repeatable)")
+	flag.Var(optional{&restore.Receive.NoMount}, "no-mount", "Leaves the restored file system unmounted (--no-mount=false mounts it regardless of the configuration)")
+	flag.Var(optional{&restore.Receive.Force}, "force", "Rolls the restored file system back to its most recent snapshot before receiving (--force=false disables a configured force)")
+	flag.StringVar(&restore.Receive.Discard, "discard", "", "Forms the restored name from the target and the original name without its pool (first) or parents (parents)")
+	flag.StringVar(&restore.Snapshot, "snapshot", "", "Restores only the archives needed to reach the named snapshot")
+	flag.IntVar(&restore.Archive, "archive", -1, "Restores only the archives up to and including the numbered archive")
+	flag.BoolVar(&restore.Rollback, "rollback", false, "Rolls back to the restored snapshot if later snapshots were received with it")
+	flag.BoolVar(&status.Active, "status", false, "Reports how far each destination lags behind its file system")
+	flag.StringVar(&status.Format, "format", "table", "The status output format (table or json)")
+	flag.BoolVar(&daemon.Active, "daemon", false, "Runs continuously, snapping, sending, and pruning as each becomes due")
 	flag.StringVar(&configuration, "configuration", "/etc/snapr.conf", "Specify an alternate configuration file")
 	flag.StringVar(&fileSystem, "file-system", "", "A file system")
 	flag.BoolVar(&debug, "debug", false, "Sets log level to debug")
+	flag.BoolVar(&dryRun, "dry-run", false, "Prints the operations which would be performed without performing them")
 }
 
 func main() {
 	flag.Parse()
 	logger()
 
-	err := run()
+	code, err := run()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error: %s\n", err)
-		os.Exit(1)
 	}
+	os.Exit(code)
 }
 
-func run() error {
+// run performs the requested mode and returns the exit code.
+func run() (int, error) {
 	ctx := newContext()
 
 	settings := snapr.NewSettings()
 	err := settings.Load(configuration)
 	if err != nil {
-		return err
+		return exitError, err
+	}
+
+	options := make([]snapr.Option, 0)
+	if dryRun {
+		if daemon.Active {
+			return exitError, fmt.Errorf("a dry run is not supported by the daemon")
+		}
+		options = append(options, snapr.WithDryRun(os.Stdout))
 	}
 
-	s, err := snapr.New(ctx, settings)
+	s, err := snapr.New(ctx, settings, options...)
 	if err != nil {
-		return fmt.Errorf("unable to restore (%w)", err)
+		return exitError, fmt.Errorf("unable to restore (%w)", err)
+	}
+
+	if only(snap.Active, send.Active, prune.Active, restore.Active, status.Active, daemon.Active) {
+		return exit(s.Snap())
 	}
 
-	if snap.Active && !(restore.Active || send.Active) {
-		s.Snap()
-		return nil
+	if only(send.Active, snap.Active, prune.Active, restore.Active, status.Active, daemon.Active) {
+		return exit(s.Send())
 	}
 
-	if send.Active && !(restore.Active || snap.Active) {
-		s.Send()
-		return nil
+	if only(prune.Active, snap.Active, send.Active, restore.Active, status.Active, daemon.Active) {
+		return exit(s.Prune())
 	}
 
-	if restore.Active && !(snap.Active || send.Active) {
-		return runRestore(ctx, s)
+	if only(restore.Active, snap.Active, send.Active, prune.Active, status.Active, daemon.Active) {
+		return check(runRestore(ctx, s))
 	}
 
-	return fmt.Errorf("invalid argument combination")
+	if only(status.Active, snap.Active, send.Active, prune.Active, restore.Active, daemon.Active) {
+		return check(snapr.WriteStatus(os.Stdout, s.Status(), status.Format))
+	}
+
+	if only(daemon.Active, snap.Active, send.Active, prune.Active, restore.Active, status.Active) {
+		s.Daemon(newReload(ctx))
+		return 0, nil
+	}
+
+	return exitError, fmt.Errorf("invalid argument combination")
+}
+
+// exit determines the exit code from the results of a run.
+func exit(report snapr.Report) (int, error) {
+	err := report.Err()
+	switch {
+	case err == nil:
+		return 0, nil
+	case report.Failed():
+		return exitFailed, err
+	default:
+		return exitPartial, err
+	}
+}
+
+func check(err error) (int, error) {
+	if err != nil {
+		return exitError, err
+	}
+	return 0, nil
+}
+
+// only indicates whether a mode is active to the exclusion of all others.
+func only(active bool, others ...bool) bool {
+	for _, v := range others {
+		if v {
+			return false
+		}
+	}
+	return active
 }
 
 func runRestore(ctx context.Context, s *snapr.Snapr) error {
 	if fileSystem == "" {
 		return fmt.Errorf("no file system specified")
 	}
-	return s.Restore(fileSystem)
+
+	if restore.Snapshot != "" && restore.Archive >= 0 {
+		return fmt.Errorf("only one of --snapshot and --archive can be specified")
+	}
+
+	if restore.Rollback && restore.Snapshot == "" {
+		return fmt.Errorf("--rollback requires --snapshot")
+	}
+
+	return s.RestoreWith(fileSystem, snapr.RestoreOptions{
+		Target:      restore.Target,
+		Snapshot:    restore.Snapshot,
+		Archive:     restore.Archive,
+		Rollback:    restore.Rollback,
+		Destination: restore.Destination,
+		Fallback:    restore.Fallback,
+		Receive:     restore.Receive,
+	})
+}
+
+// properties collects repeated name=value arguments.
+type properties map[string]string
+
+func (p properties) String() string {
+	pairs := make([]string, 0, len(p))
+	for name, value := range p {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (p properties) Set(value string) error {
+	pair := strings.SplitN(value, "=", 2)
+	if len(pair) != 2 || pair[0] == "" {
+		return fmt.Errorf("expected name=value but got '%s'", value)
+	}
+	p[pair[0]] = pair[1]
+	return nil
+}
+
+// list collects repeated arguments.
+type list []string
+
+func (l *list) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *list) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// optional is a boolean argument which is left nil unless given.
+type optional struct {
+	value **bool
+}
+
+func (o optional) String() string {
+	if o.value == nil || *o.value == nil {
+		return ""
+	}
+	return strconv.FormatBool(**o.value)
+}
+
+func (o optional) Set(value string) error {
+	v, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	*o.value = &v
+	return nil
+}
+
+func (o optional) IsBoolFlag() bool {
+	return true
 }
 
 func logger() {
@@ -104,3 +260,34 @@ func newContext() context.Context {
 	}()
 	return ctx
 }
+
+// newReload loads the configuration each time SIGHUP is received. A configuration which fails to load is ignored.
+func newReload(ctx context.Context) <-chan *snapr.Settings {
+	reload := make(chan *snapr.Settings)
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGHUP)
+		defer signal.Stop(signals)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-signals:
+			}
+
+			settings := snapr.NewSettings()
+			if err := settings.Load(configuration); err != nil {
+				log.Error().Msgf("ignoring reload: %s", err)
+				continue
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case reload <- settings:
+			}
+		}
+	}()
+	return reload
+}
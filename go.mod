@@ -5,8 +5,8 @@ go 1.14
 require (
 	github.com/coreos/go-systemd v0.0.0-20190321100706-95778dfbb74e // indirect
 	github.com/json-iterator/go v1.1.10
-	github.com/rs/zerolog v1.25.0 // indirect
-	github.com/stretchr/testify v1.7.0 // indirect
-	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c // indirect
+	github.com/rs/zerolog v1.25.0
+	github.com/stretchr/testify v1.7.0
+	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
 	golang.org/x/text v0.3.3
 )
@@ -0,0 +1,130 @@
+package snapr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// errExhausted indicates the budget cannot accommodate an upload without waiting.
+var errExhausted = errors.New("upload budget exhausted")
+
+// budget limits the parts being uploaded or downloaded and the memory held by part buffers across concurrent transfers.
+// A nil instance imposes no limits.
+type budget struct {
+	threads *semaphore.Weighted
+	memory  *semaphore.Weighted
+	limit   int
+	size    int64
+}
+
+// newBudget creates a budget from the global settings. The global threads cap the threads of every transfer and send
+// entries with more threads are warned about as they're reduced to the global threads. Memory defaults to enough buffers
+// for every thread using the largest part size.
+func newBudget(settings *Settings) *budget {
+	threads := settings.Threads
+	if threads < 1 {
+		threads = 1
+	}
+
+	partSize := settings.PartSize
+	for target, fs := range settings.FileSystems {
+		for _, entry := range fs.Send {
+			if entry.Threads > threads {
+				Logger.Warn().Msgf("send of '%s' to %s is limited to the global %d threads", target, entry.destination(), threads)
+			}
+			if entry := entry.Inherit(settings); entry.PartSize > partSize {
+				partSize = entry.PartSize
+			}
+		}
+	}
+
+	memory := int64(settings.Memory) * Megabyte
+	if memory <= 0 {
+		memory = int64(threads) * int64(partSize) * Megabyte
+	}
+
+	return &budget{
+		threads: semaphore.NewWeighted(int64(threads)),
+		memory:  semaphore.NewWeighted(memory),
+		limit:   threads,
+		size:    memory,
+	}
+}
+
+// reserve waits until buffers for the threads are available. The number of threads is reduced if the buffers would
+// exceed the budget. A single buffer larger than the budget can never be reserved and is refused. If wait is false and
+// the buffers aren't available errExhausted is returned. The reserved bytes must be returned with free.
+func (b *budget) reserve(ctx context.Context, threads, partSize int, wait bool) (int, int64, error) {
+	if b == nil {
+		return threads, 0, nil
+	}
+
+	if int64(partSize) > b.size {
+		return 0, 0, fmt.Errorf("part size of %d MB exceeds the memory budget of %d MB", partSize/Megabyte, b.size/Megabyte)
+	}
+
+	if fit := int(b.size / int64(partSize)); threads > fit {
+		threads = fit
+	}
+	if threads < 1 {
+		threads = 1
+	}
+
+	reserved := int64(threads) * int64(partSize)
+	if !wait {
+		if !b.memory.TryAcquire(reserved) {
+			return 0, 0, errExhausted
+		}
+		return threads, reserved, nil
+	}
+
+	if err := b.memory.Acquire(ctx, reserved); err != nil {
+		return 0, 0, err
+	}
+	return threads, reserved, nil
+}
+
+func (b *budget) free(reserved int64) {
+	if b == nil || reserved == 0 {
+		return
+	}
+	b.memory.Release(reserved)
+}
+
+// acquire waits for a thread to transfer a part.
+func (b *budget) acquire(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+	return b.threads.Acquire(ctx, 1)
+}
+
+func (b *budget) release() {
+	if b == nil {
+		return
+	}
+	b.threads.Release(1)
+}
+
+// fits indicates whether the threads could be held at once.
+func (b *budget) fits(threads int) bool {
+	return b == nil || threads <= b.limit
+}
+
+// hold waits for several threads at once. The threads must be returned with unhold.
+func (b *budget) hold(ctx context.Context, threads int) error {
+	if b == nil {
+		return nil
+	}
+	return b.threads.Acquire(ctx, int64(threads))
+}
+
+func (b *budget) unhold(threads int) {
+	if b == nil {
+		return
+	}
+	b.threads.Release(int64(threads))
+}
@@ -0,0 +1,112 @@
+package snapr
+
+import (
+	"context"
+	"fmt"
+	"snapr/internal/stow/stowtest"
+	"snapr/internal/zed"
+	"snapr/internal/zed/zedtest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBudget(t *testing.T) {
+	settings := NewSettings()
+	settings.Threads = 4
+	settings.PartSize = 1
+	settings.Memory = 3
+
+	b := newBudget(settings)
+
+	// The threads are reduced to fit within the memory.
+	threads, reserved, err := b.reserve(context.Background(), 4, Megabyte, true)
+	require.NoError(t, err)
+	assert.Equal(t, 3, threads)
+	assert.Equal(t, int64(3*Megabyte), reserved)
+
+	// Further uploads wait until the buffers are freed.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, _, err = b.reserve(ctx, 1, Megabyte, true)
+	assert.Error(t, err)
+	_, _, err = b.reserve(context.Background(), 1, Megabyte, false)
+	assert.Equal(t, errExhausted, err)
+
+	b.free(reserved)
+	threads, reserved, err = b.reserve(context.Background(), 1, Megabyte, true)
+	require.NoError(t, err)
+	assert.Equal(t, 1, threads)
+	b.free(reserved)
+
+	// A part larger than the memory can never be reserved.
+	_, _, err = b.reserve(context.Background(), 1, 4*Megabyte, true)
+	assert.Error(t, err)
+	_, _, err = b.reserve(context.Background(), 1, 4*Megabyte, false)
+	assert.Error(t, err)
+	assert.NotEqual(t, errExhausted, err)
+
+	// A nil budget imposes no limits.
+	var unlimited *budget
+	threads, _, err = unlimited.reserve(context.Background(), 8, Megabyte, true)
+	require.NoError(t, err)
+	assert.Equal(t, 8, threads)
+	require.NoError(t, unlimited.acquire(context.Background()))
+	unlimited.release()
+}
+
+func TestBudgetSize(t *testing.T) {
+	settings := testSettings("pool-0/test")
+	settings.Concurrency = 2
+	entries := settings.FileSystems["pool-0/test"]
+	entries.Send[0].Threads = 5
+	entries.Send[0].PartSize = 2
+	settings.FileSystems["pool-0/test"] = entries
+
+	// The global threads cap every entry and the memory fits a buffer of the largest part for each thread.
+	b := newBudget(settings)
+	assert.Equal(t, 2, entries.Send[0].Inherit(settings).Threads)
+	assert.True(t, b.threads.TryAcquire(2))
+	assert.False(t, b.threads.TryAcquire(1))
+	assert.True(t, b.fits(2))
+	assert.False(t, b.fits(3))
+	assert.Equal(t, int64(4*Megabyte), b.size)
+
+	// Memory which is set limits the buffers.
+	settings.Memory = 3
+	assert.Equal(t, int64(3*Megabyte), newBudget(settings).size)
+}
+
+func TestSendConcurrently(t *testing.T) {
+	local := zedtest.New()
+	testClock(local)
+
+	settings := testSettings("pool-0/fs-0")
+	settings.Concurrency = 3
+	settings.Memory = 3
+	entries := settings.FileSystems["pool-0/fs-0"]
+
+	filesystems := make([]zed.FileSystem, 0)
+	for i := 0; i < 5; i++ {
+		fs := zed.FileSystem{Pool: "pool-0", Name: fmt.Sprintf("fs-%d", i)}
+		require.NoError(t, local.CreateFileSystem(fs))
+		require.NoError(t, local.Write(fs, testData(byte(i), 3*Megabyte)))
+		settings.FileSystems[fs.String()] = entries
+		filesystems = append(filesystems, fs)
+	}
+
+	provider := stowtest.New(testEndpoint)
+	s := testSnapr(t, local, provider, settings)
+	require.NoError(t, s.Snap().Err())
+
+	report := s.Send()
+	require.NoError(t, report.Err())
+	require.Len(t, report.Results, len(filesystems))
+
+	for i, fs := range filesystems {
+		assert.Equal(t, fs.String(), report.Results[i].FileSystem, "results are ordered by file system")
+		assert.Contains(t, provider.Keys("bucket"), fs.String()+"/00000/contents")
+	}
+}
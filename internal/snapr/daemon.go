@@ -0,0 +1,316 @@
+package snapr
+
+import (
+	"context"
+	"snapr/internal/zed"
+	"sync"
+	"time"
+)
+
+// Daemon snaps, sends, and prunes each file system as operations fall due until the context is cancelled. Operations on
+// a file system are run one after another while separate file systems proceed independently, up to the configured
+// concurrency. Settings received from reload replace the current settings once running operations have finished. File
+// systems which were already running keep their pending retries and aren't sent and pruned again as they were at startup.
+func (s *Snapr) Daemon(reload <-chan *Settings) {
+	current := s
+	workers := make(map[string]*worker)
+	for {
+		ctx, cancel := context.WithCancel(s.ctx)
+
+		concurrency := current.settings.Concurrency
+		if concurrency < 1 {
+			concurrency = 1
+		}
+		slots := make(chan struct{}, concurrency)
+
+		var wg sync.WaitGroup
+		running := make(map[string]*worker)
+		for target, settings := range current.settings.FileSystems {
+			w, err := current.newWorker(target, settings, slots)
+			if err != nil {
+				Logger.Warn().Msgf("skipping '%s': %s", target, err)
+				continue
+			}
+
+			previous, initial := workers[target], true
+			if previous != nil {
+				w.carry(previous)
+				initial = false
+			}
+			running[target] = w
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				w.run(ctx, initial)
+			}()
+		}
+		workers = running
+
+		Logger.Info().Msgf("daemon running for %d file systems", len(current.settings.FileSystems))
+
+		select {
+		case <-s.ctx.Done():
+			cancel()
+			wg.Wait()
+			Logger.Info().Msg("daemon stopped")
+			return
+		case settings := <-reload:
+			Logger.Info().Msg("reloading settings once running operations have finished")
+			cancel()
+			wg.Wait()
+
+			next := *current
+			next.settings = settings
+			next.metrics = newMetrics(settings.Metrics)
+			next.budget = newBudget(settings)
+			current = &next
+		}
+	}
+}
+
+// worker runs the operations for a single file system. A slot shared between the workers is held while running them.
+// Following a failure the next cycle is held back until the retry time. Sends which failed are keyed by destination and
+// are run again in the next cycle, as is a prune which failed.
+type worker struct {
+	snapr    *Snapr
+	target   string
+	fs       zed.FileSystem
+	settings FileSystemSettings
+	slots    chan struct{}
+	sent     map[int]time.Time
+	retry    time.Time
+	failed   map[string]bool
+	unpruned bool
+}
+
+func (s *Snapr) newWorker(target string, settings FileSystemSettings, slots chan struct{}) (*worker, error) {
+	fs, err := zed.ToFileSystem(target)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &worker{
+		snapr:    s,
+		target:   target,
+		fs:       *fs,
+		settings: settings,
+		slots:    slots,
+		sent:     make(map[int]time.Time),
+		failed:   make(map[string]bool),
+	}
+
+	for i, entry := range settings.Send {
+		if entry.Schedule == "" {
+			continue
+		}
+
+		state, err := readState(s.ctx, s.zed, *fs, entry)
+		if err != nil {
+			return nil, err
+		}
+
+		if state != nil {
+			w.sent[i] = state.Time
+		}
+	}
+	return w, nil
+}
+
+// carry takes over the pending retries of the worker the file system had before the settings were reloaded. Failed
+// sends to destinations which are no longer configured are dropped.
+func (w *worker) carry(previous *worker) {
+	w.retry = previous.retry
+	w.unpruned = previous.unpruned && retains(w.settings.Snap)
+	for _, entry := range w.settings.Send {
+		if previous.failed[entry.destination()] {
+			w.failed[entry.destination()] = true
+		}
+	}
+}
+
+// run runs cycles as operations fall due. The initial cycle runs immediately and sends and prunes everything.
+func (w *worker) run(ctx context.Context, initial bool) {
+	if initial && !w.guarded(ctx, true) {
+		return
+	}
+
+	for {
+		next, ok := w.next()
+
+		wait := DaemonPoll
+		if ok && time.Until(next) < wait {
+			wait = time.Until(next)
+		}
+		if time.Until(w.retry) > wait {
+			wait = time.Until(w.retry)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		if ok && !time.Now().Before(next) && !w.guarded(ctx, false) {
+			return
+		}
+	}
+}
+
+// guarded runs a cycle once a slot is available. False is returned if the context is cancelled while waiting.
+func (w *worker) guarded(ctx context.Context, initial bool) bool {
+	select {
+	case w.slots <- struct{}{}:
+	case <-ctx.Done():
+		return false
+	}
+
+	defer func() {
+		<-w.slots
+	}()
+
+	w.cycle(initial)
+	return true
+}
+
+// cycle creates any snapshots which are due then sends and prunes. Sends without a schedule follow the creation of a
+// snapshot. Everything is sent and pruned on the initial cycle.
+func (w *worker) cycle(initial bool) {
+	now := time.Now()
+
+	results := make([]Result, 0)
+	if len(w.settings.Snap) > 0 {
+		results = w.snapr.newSnapper().snapFileSystem(w.target, w.settings.Snap)
+	}
+
+	created := 0
+	for _, v := range results {
+		if v.Err == nil {
+			created++
+		}
+	}
+
+	// The sends which are due are sent together so destinations sharing a stream are sent from a single 'zfs send'.
+	indexes := make([]int, 0)
+	entries := make([]SendEntry, 0)
+	for i, entry := range w.settings.Send {
+		if entry.Schedule != "" {
+			due, ok := w.sendDue(i, entry)
+			if !ok || now.Before(due) {
+				continue
+			}
+		} else if !initial && created == 0 && !w.failed[entry.destination()] {
+			continue
+		}
+
+		indexes = append(indexes, i)
+		entries = append(entries, entry)
+	}
+
+	if len(entries) > 0 {
+		for i, result := range w.snapr.newSender().sendFileSystem(w.target, entries) {
+			if result.Err == nil {
+				w.sent[indexes[i]] = now
+				delete(w.failed, entries[i].destination())
+			} else {
+				w.failed[entries[i].destination()] = true
+			}
+			results = append(results, result)
+		}
+	}
+
+	if retains(w.settings.Snap) && (initial || created > 0 || w.unpruned) {
+		pruned := w.snapr.newPruner().pruneFileSystem(w.target, w.settings)
+		w.unpruned = false
+		for _, v := range pruned {
+			if v.Err != nil {
+				w.unpruned = true
+			}
+		}
+		results = append(results, pruned...)
+	}
+
+	// Operations which failed are still due so the next cycle is held back rather than retrying them immediately.
+	for _, v := range results {
+		if v.Err != nil {
+			w.retry = now.Add(DaemonRetry)
+			break
+		}
+	}
+
+	w.snapr.writeMetrics()
+	w.snapr.notify(Report{Operation: "daemon", Results: results})
+}
+
+// next determines when the next operation falls due. False is returned if nothing is scheduled.
+func (w *worker) next() (time.Time, bool) {
+	var next time.Time
+	scheduled := false
+
+	earliest := func(due time.Time) {
+		if !scheduled || due.Before(next) {
+			next = due
+			scheduled = true
+		}
+	}
+
+	if len(w.settings.Snap) > 0 {
+		snapper := w.snapr.newSnapper()
+		listing, err := w.snapr.zed.ListSnapshots(w.snapr.ctx, w.fs)
+		if err != nil {
+			Logger.Warn().Msgf("failed to list snapshots for '%s': %s", w.fs, err)
+		} else {
+			for _, entry := range w.settings.Snap {
+				template, err := entry.template()
+				if err != nil {
+					Logger.Warn().Msgf("skipping snapshot on '%s': %s", w.target, err)
+					continue
+				}
+
+				due, ok, err := snapper.due(entry, template, listing)
+				if err != nil {
+					Logger.Warn().Msgf("skipping snapshot on '%s': %s", w.target, err)
+					continue
+				}
+
+				if ok {
+					earliest(due)
+				}
+			}
+		}
+	}
+
+	for i, entry := range w.settings.Send {
+		if entry.Schedule != "" {
+			if due, ok := w.sendDue(i, entry); ok {
+				earliest(due)
+			}
+		}
+	}
+
+	// Failed sends and prunes are run again once the retry time passes.
+	if len(w.failed) > 0 || w.unpruned {
+		earliest(w.retry)
+	}
+	return next, scheduled
+}
+
+// sendDue determines when a scheduled send falls due based on when it last ran.
+func (w *worker) sendDue(index int, entry SendEntry) (time.Time, bool) {
+	schedule, err := parseSchedule(entry.Schedule)
+	if err != nil {
+		Logger.Warn().Msgf("sending failed for %s: could not parse schedule '%s' (%s)", w.target, entry.Schedule, err)
+		return time.Time{}, false
+	}
+
+	last, ok := w.sent[index]
+	if !ok {
+		return last, true
+	}
+
+	next := schedule.next(last)
+	return next, !next.IsZero()
+}
@@ -0,0 +1,346 @@
+package snapr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"snapr/internal/stow"
+	"snapr/internal/stow/stowtest"
+	"snapr/internal/zed"
+	"snapr/internal/zed/zedtest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDaemon(t *testing.T) {
+	first := zed.FileSystem{Pool: "pool-0", Name: "first"}
+	second := zed.FileSystem{Pool: "pool-0", Name: "second"}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	local := zedtest.New()
+	require.NoError(t, local.CreateFileSystem(first))
+	require.NoError(t, local.CreateFileSystem(second))
+	require.NoError(t, local.Write(first, testData(1, 100)))
+	require.NoError(t, local.Write(second, testData(2, 100)))
+
+	provider := stowtest.New(testEndpoint)
+	s, err := New(ctx, testSettings(first.String()), WithZFS(local), WithForwarder(provider.Forward))
+	require.NoError(t, err)
+
+	reload := make(chan *Settings)
+	stopped := make(chan struct{})
+	go func() {
+		s.Daemon(reload)
+		close(stopped)
+	}()
+
+	archived := func(key string) func() bool {
+		return func() bool {
+			return contains(provider.Keys("bucket"), key)
+		}
+	}
+
+	// The initial cycle snaps and sends.
+	assert.Eventually(t, archived("pool-0/first/00000/contents"), 5*time.Second, 10*time.Millisecond)
+
+	// Reloading adds the second file system.
+	settings := testSettings(first.String())
+	settings.FileSystems[second.String()] = settings.FileSystems[first.String()]
+	reload <- settings
+
+	assert.Eventually(t, archived("pool-0/second/00000/contents"), 5*time.Second, 10*time.Millisecond)
+
+	// Snapshots are not created until the interval elapses.
+	listing, err := local.ListSnapshots(context.Background(), first)
+	require.NoError(t, err)
+	assert.Len(t, listing, 1)
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("daemon did not stop")
+	}
+}
+
+// slowZFS delays each send and records the most sends running at once.
+type slowZFS struct {
+	*zedtest.Fake
+	mu     sync.Mutex
+	active int
+	peak   int
+}
+
+func (z *slowZFS) Send(ctx context.Context, source zed.Addressable, target zed.Snapshot, completion func(error) error) (*zed.Stream, error) {
+	z.mu.Lock()
+	z.active++
+	if z.active > z.peak {
+		z.peak = z.active
+	}
+	z.mu.Unlock()
+
+	time.Sleep(50 * time.Millisecond)
+
+	z.mu.Lock()
+	z.active--
+	z.mu.Unlock()
+	return z.Fake.Send(ctx, source, target, completion)
+}
+
+func TestDaemonConcurrency(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	local := &slowZFS{Fake: zedtest.New()}
+	settings := testSettings("pool-0/fs-0")
+	settings.Concurrency = 2
+	for i := 0; i < 4; i++ {
+		fs := zed.FileSystem{Pool: "pool-0", Name: fmt.Sprintf("fs-%d", i)}
+		require.NoError(t, local.CreateFileSystem(fs))
+		require.NoError(t, local.Write(fs, testData(byte(i), 100)))
+		settings.FileSystems[fs.String()] = settings.FileSystems["pool-0/fs-0"]
+	}
+
+	provider := stowtest.New(testEndpoint)
+	s, err := New(ctx, settings, WithZFS(local), WithForwarder(provider.Forward))
+	require.NoError(t, err)
+
+	stopped := make(chan struct{})
+	go func() {
+		s.Daemon(make(chan *Settings))
+		close(stopped)
+	}()
+
+	assert.Eventually(t, func() bool {
+		keys := provider.Keys("bucket")
+		for i := 0; i < 4; i++ {
+			if !contains(keys, fmt.Sprintf("pool-0/fs-%d/00000/contents", i)) {
+				return false
+			}
+		}
+		return true
+	}, 10*time.Second, 10*time.Millisecond)
+
+	cancel()
+	<-stopped
+
+	local.mu.Lock()
+	defer local.mu.Unlock()
+	assert.Equal(t, 2, local.peak, "file systems are sent up to the configured concurrency")
+}
+
+func TestWorkerNext(t *testing.T) {
+	fs := zed.FileSystem{Pool: "pool-0", Name: "test"}
+
+	local := zedtest.New()
+	require.NoError(t, local.CreateFileSystem(fs))
+
+	settings := testSettings(fs.String())
+	entries := settings.FileSystems[fs.String()]
+	entries.Send[0].Schedule = "daily"
+	settings.FileSystems[fs.String()] = entries
+
+	s := testSnapr(t, local, stowtest.New(testEndpoint), settings)
+	w, err := s.newWorker(fs.String(), entries, make(chan struct{}, 1))
+	require.NoError(t, err)
+
+	// Nothing has been snapped or sent so everything is due immediately.
+	next, ok := w.next()
+	assert.True(t, ok)
+	assert.True(t, next.IsZero())
+
+	now := time.Now()
+	require.NoError(t, local.CreateSnapshot(context.Background(), zed.Snapshot{Addr: zed.Address{FileSystem: fs, Name: "daily-00000"}}))
+	w.sent[0] = now
+
+	next, ok = w.next()
+	assert.True(t, ok)
+	assert.WithinDuration(t, now.Add(time.Hour), next, time.Minute, "the snapshot interval elapses before the daily send")
+}
+
+func TestWorkerRetry(t *testing.T) {
+	fs := zed.FileSystem{Pool: "pool-0", Name: "test"}
+
+	local := zedtest.New()
+	require.NoError(t, local.CreateFileSystem(fs))
+	require.NoError(t, local.Write(fs, testData(1, 100)))
+
+	settings := testSettings(fs.String())
+	entries := settings.FileSystems[fs.String()]
+	entries.Send[0].Schedule = "daily"
+	settings.FileSystems[fs.String()] = entries
+
+	provider := stowtest.New(testEndpoint)
+	provider.Fail = func(req *http.Request) error {
+		return &stow.StatusError{StatusCode: http.StatusForbidden}
+	}
+
+	s := testSnapr(t, local, provider, settings)
+	w, err := s.newWorker(fs.String(), entries, make(chan struct{}, 1))
+	require.NoError(t, err)
+
+	// A failed send isn't recorded so it's retried once the retry time passes.
+	start := time.Now()
+	w.cycle(true)
+	assert.NotContains(t, w.sent, 0)
+	assert.WithinDuration(t, start.Add(DaemonRetry), w.retry, time.Minute)
+
+	next, ok := w.next()
+	assert.True(t, ok)
+	assert.True(t, next.IsZero(), "the failed send is still due")
+
+	provider.Fail = nil
+	w.retry = time.Time{}
+	w.cycle(false)
+	assert.Contains(t, w.sent, 0)
+	assert.True(t, w.retry.IsZero(), "a successful cycle isn't held back")
+}
+
+func TestDaemonShared(t *testing.T) {
+	fs := zed.FileSystem{Pool: "pool-0", Name: "test"}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	local := &countingZFS{Fake: zedtest.New()}
+	require.NoError(t, local.CreateFileSystem(fs))
+	require.NoError(t, local.Write(fs, testData(1, 100)))
+
+	settings := testSettings(fs.String())
+	entries := settings.FileSystems[fs.String()]
+	second := entries.Send[0]
+	second.Bucket = "second"
+	second.Release = []string{"second"}
+	entries.Send = append(entries.Send, second)
+	entries.Snap[0].Hold = []string{"test", "second"}
+	settings.FileSystems[fs.String()] = entries
+
+	provider := stowtest.New(testEndpoint)
+	s, err := New(ctx, settings, WithZFS(local), WithForwarder(provider.Forward))
+	require.NoError(t, err)
+
+	stopped := make(chan struct{})
+	go func() {
+		s.Daemon(make(chan *Settings))
+		close(stopped)
+	}()
+
+	assert.Eventually(t, func() bool {
+		return contains(provider.Keys("bucket"), "pool-0/test/00000/contents") && contains(provider.Keys("second"), "pool-0/test/00000/contents")
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	<-stopped
+
+	local.mu.Lock()
+	defer local.mu.Unlock()
+	assert.Equal(t, 1, local.sends, "both destinations share a stream")
+}
+
+func TestWorkerRetryUnscheduled(t *testing.T) {
+	fs := zed.FileSystem{Pool: "pool-0", Name: "test"}
+
+	local := zedtest.New()
+	require.NoError(t, local.CreateFileSystem(fs))
+	require.NoError(t, local.Write(fs, testData(1, 100)))
+
+	settings := testSettings(fs.String())
+	entries := settings.FileSystems[fs.String()]
+	entries.Snap[0].Retain = Retention{Last: 1}
+	settings.FileSystems[fs.String()] = entries
+
+	provider := stowtest.New(testEndpoint)
+	provider.Fail = func(req *http.Request) error {
+		return &stow.StatusError{StatusCode: http.StatusForbidden}
+	}
+
+	s := testSnapr(t, local, provider, settings)
+	w, err := s.newWorker(fs.String(), entries, make(chan struct{}, 1))
+	require.NoError(t, err)
+
+	// The send and the prune fail as the bucket can't be reached.
+	w.cycle(true)
+	assert.True(t, w.failed[entries.Send[0].destination()])
+	assert.True(t, w.unpruned)
+
+	next, ok := w.next()
+	assert.True(t, ok)
+	assert.Equal(t, w.retry, next, "the failures are due once the retry time passes")
+
+	// No snapshot is due but the failed send and prune are run again.
+	provider.Fail = nil
+	w.cycle(false)
+	assert.Empty(t, w.failed)
+	assert.False(t, w.unpruned)
+	assert.Contains(t, provider.Keys("bucket"), "pool-0/test/00000/contents")
+}
+
+func TestDaemonReload(t *testing.T) {
+	first := zed.FileSystem{Pool: "pool-0", Name: "first"}
+	second := zed.FileSystem{Pool: "pool-0", Name: "second"}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	notified := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n notification
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&n))
+
+		mu.Lock()
+		defer mu.Unlock()
+		for _, v := range n.FileSystems {
+			notified[v.FileSystem]++
+		}
+	}))
+	defer server.Close()
+
+	local := zedtest.New()
+	require.NoError(t, local.CreateFileSystem(first))
+	require.NoError(t, local.CreateFileSystem(second))
+
+	settings := testSettings(first.String())
+	settings.Notify = NotifySettings{On: NotifyAlways, Webhook: Webhook{URL: server.URL}}
+
+	provider := stowtest.New(testEndpoint)
+	s, err := New(ctx, settings, WithZFS(local), WithForwarder(provider.Forward))
+	require.NoError(t, err)
+
+	reload := make(chan *Settings)
+	stopped := make(chan struct{})
+	go func() {
+		s.Daemon(reload)
+		close(stopped)
+	}()
+
+	count := func(fs zed.FileSystem) func() bool {
+		return func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return notified[fs.String()] > 0
+		}
+	}
+	assert.Eventually(t, count(first), 5*time.Second, 10*time.Millisecond)
+
+	// Only the added file system runs an initial cycle.
+	reloaded := testSettings(first.String())
+	reloaded.Notify = settings.Notify
+	reloaded.FileSystems[second.String()] = reloaded.FileSystems[first.String()]
+	reload <- reloaded
+
+	assert.Eventually(t, count(second), 5*time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+
+	cancel()
+	<-stopped
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 1, notified[first.String()])
+}
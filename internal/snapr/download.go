@@ -0,0 +1,187 @@
+package snapr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// readAhead is the most of each part which is read before the part is written.
+const readAhead = 8 * Megabyte
+
+// byteRange is a part of a volume fetched by a single request.
+type byteRange struct {
+	path  string
+	begin int
+	end   int
+}
+
+// ranges divides the volumes into parts of the configured size using the sizes from the bucket listing.
+func (r *remote) ranges(volumes []string) ([]byteRange, error) {
+	partSize := r.entry.PartSize * Megabyte
+	ranges := make([]byteRange, 0, len(volumes))
+
+	for _, v := range volumes {
+		size, ok := r.sizes[v]
+		if !ok || size == 0 {
+			return nil, fmt.Errorf("size of '%s' is unknown", v)
+		}
+
+		for begin := 0; begin < size; begin += partSize {
+			ranges = append(ranges, byteRange{v, begin, min(begin+partSize, size) - 1})
+		}
+	}
+	return ranges, nil
+}
+
+// download fetches the volumes in parts using the configured number of threads and writes them to w in order. The
+// first readAhead bytes of each part are fetched ahead of the one being written. The rest of a larger part is requested
+// once the part is written and streamed to w, so memory use doesn't depend on the part size and no response is left
+// idle while earlier parts are written.
+func (r *remote) download(volumes []string, w io.Writer) error {
+	ranges, err := r.ranges(volumes)
+	if err != nil {
+		return err
+	}
+
+	threads := r.entry.Threads
+	if threads < 1 {
+		threads = 1
+	}
+
+	size := min(r.entry.PartSize*Megabyte, readAhead)
+	threads, reserved, err := r.budget.reserve(r.ctx, threads, size, true)
+	if err != nil {
+		return err
+	}
+	defer r.budget.free(reserved)
+
+	// A slot is taken before a part is requested and returned once it has been written.
+	slots := make(chan struct{}, threads)
+	parts := make([]chan []byte, len(ranges))
+	for i := range parts {
+		parts[i] = make(chan []byte, 1)
+	}
+
+	eg, ctx := errgroup.WithContext(r.ctx)
+
+	eg.Go(func() error {
+		for i := range ranges {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+
+			if err := r.budget.acquire(ctx); err != nil {
+				return err
+			}
+
+			i := i
+			eg.Go(func() error {
+				return r.fetch(ctx, ranges[i], size, parts[i])
+			})
+		}
+		return nil
+	})
+
+	eg.Go(func() error {
+		for i, v := range ranges {
+			select {
+			case head := <-parts[i]:
+				if err := r.write(ctx, v, head, w); err != nil {
+					return err
+				}
+				<-slots
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	})
+
+	return eg.Wait()
+}
+
+// fetch requests up to size bytes from the start of a part and reads them. The thread taken for the part is returned
+// once the content has been read.
+func (r *remote) fetch(ctx context.Context, part byteRange, size int, out chan<- []byte) error {
+	defer r.budget.release()
+
+	end := min(part.end, part.begin+size-1)
+	head, err := r.read(ctx, part.path, part.begin, end)
+	if err != nil {
+		return err
+	}
+
+	out <- head
+	return nil
+}
+
+// read requests a range of a volume and reads its content. A short body is returned as is and detected by write.
+func (r *remote) read(ctx context.Context, path string, begin, end int) ([]byte, error) {
+	object, err := r.stow.GetObjectStream(ctx, r.entry.Bucket, path, begin, end)
+	if err != nil {
+		return nil, fmt.Errorf("%w", err)
+	}
+	defer object.Body.Close()
+
+	content := make([]byte, end-begin+1)
+	n, err := io.ReadFull(object.Body, content)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, fmt.Errorf("reading bytes %d to %d of '%s' failed (%w)", begin, end, path, err)
+	}
+	return content[:n], nil
+}
+
+// write copies the content of a part to w. If the part is larger than the head which was read ahead the rest is requested
+// using a thread from the budget and streamed to w.
+func (r *remote) write(ctx context.Context, part byteRange, head []byte, w io.Writer) error {
+	expected := part.end - part.begin + 1
+
+	n, err := w.Write(head)
+	if err != nil {
+		return err
+	}
+
+	if n == readAhead && n < expected {
+		rest, err := r.stream(ctx, part.path, part.begin+n, part.end, w)
+		if err != nil {
+			return err
+		}
+		n += rest
+	}
+
+	if n != expected {
+		return fmt.Errorf("expected %d bytes of '%s' from %d but received %d", expected, part.path, part.begin, n)
+	}
+
+	Logger.Debug().Msgf("downloaded bytes %d to %d of %s", part.begin, part.end, part.path)
+	if part.end+1 == r.sizes[part.path] {
+		Logger.Info().Msgf("downloaded %s (%d MB)", part.path, r.sizes[part.path]/Megabyte)
+	}
+	return nil
+}
+
+// stream requests a range of a volume and copies its content to w.
+func (r *remote) stream(ctx context.Context, path string, begin, end int, w io.Writer) (int, error) {
+	if err := r.budget.acquire(ctx); err != nil {
+		return 0, err
+	}
+	defer r.budget.release()
+
+	object, err := r.stow.GetObjectStream(ctx, r.entry.Bucket, path, begin, end)
+	if err != nil {
+		return 0, fmt.Errorf("%w", err)
+	}
+	defer object.Body.Close()
+
+	n, err := io.Copy(w, io.LimitReader(object.Body, int64(end-begin+1)))
+	if err != nil {
+		return int(n), fmt.Errorf("reading bytes %d to %d of '%s' failed (%w)", begin, end, path, err)
+	}
+	return int(n), nil
+}
@@ -0,0 +1,167 @@
+package snapr
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"snapr/internal/stow/stowtest"
+	"snapr/internal/zed"
+	"snapr/internal/zed/zedtest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownload(t *testing.T) {
+	// Parts are downloaded by every thread of the destination.
+	testDownload(t, 0, 3)
+
+	// Global threads held by other transfers limit the parts being downloaded.
+	testDownload(t, 1, 2)
+}
+
+func testDownload(t *testing.T, held, peak int) {
+	fs := zed.FileSystem{Pool: "pool-0", Name: "test"}
+	ctx := context.Background()
+
+	provider := stowtest.New(testEndpoint)
+	settings := testSettings(fs.String())
+	settings.Threads = 3
+	settings.FileSystems[fs.String()].Send[0].Threads = 3
+	s := testSnapr(t, zedtest.New(), provider, settings)
+	entry := settings.FileSystems[fs.String()].Send[0].Inherit(settings)
+	require.True(t, s.budget.threads.TryAcquire(int64(held)))
+
+	first, second := testData(1, 5*Megabyte/2), testData(2, 3*Megabyte/2)
+	r, err := newRemote(ctx, s.zed, entry, nil, s.stow...)
+	require.NoError(t, err)
+	_, err = r.stow.PutObject(ctx, "bucket", "pool-0/test/00000/00000", first)
+	require.NoError(t, err)
+	_, err = r.stow.PutObject(ctx, "bucket", "pool-0/test/00000/00001", second)
+	require.NoError(t, err)
+
+	// Earlier parts are slower so later parts complete first.
+	var mu sync.Mutex
+	active, concurrent, requests := 0, 0, 0
+	provider.Fail = func(req *http.Request) error {
+		if req.Method != http.MethodGet || req.URL.Query().Get("list-type") != "" {
+			return nil
+		}
+
+		mu.Lock()
+		active++
+		requests++
+		if active > concurrent {
+			concurrent = active
+		}
+		delay := time.Duration(10-requests) * 10 * time.Millisecond
+		mu.Unlock()
+
+		time.Sleep(delay)
+
+		mu.Lock()
+		active--
+		mu.Unlock()
+		return nil
+	}
+
+	r, err = newRemote(ctx, s.zed, entry, nil, s.stow...)
+	require.NoError(t, err)
+	r.budget = s.budget
+
+	var out bytes.Buffer
+	require.NoError(t, r.download([]string{"pool-0/test/00000/00000", "pool-0/test/00000/00001"}, &out))
+	assert.Equal(t, append(first, second...), out.Bytes())
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 5, requests)
+	assert.Equal(t, peak, concurrent)
+}
+
+func TestDownloadOrder(t *testing.T) {
+	fs := zed.FileSystem{Pool: "pool-0", Name: "test"}
+	ctx := context.Background()
+
+	// Other transfers hold all but one of the global threads so it's shared by three destination threads. Only the read
+	// ahead of each part is fetched in advance and the rest of the first part is requested once it is being written.
+	provider := stowtest.New(testEndpoint)
+	settings := testSettings(fs.String())
+	settings.Threads = 3
+	settings.FileSystems[fs.String()].Send[0].Threads = 3
+	settings.FileSystems[fs.String()].Send[0].PartSize = 10
+	s := testSnapr(t, zedtest.New(), provider, settings)
+	entry := settings.FileSystems[fs.String()].Send[0].Inherit(settings)
+	require.True(t, s.budget.threads.TryAcquire(2))
+
+	first, second := testData(1, 12*Megabyte), testData(2, 3*Megabyte)
+	r, err := newRemote(ctx, s.zed, entry, nil, s.stow...)
+	require.NoError(t, err)
+	_, err = r.stow.PutObject(ctx, "bucket", "pool-0/test/00000/00000", first)
+	require.NoError(t, err)
+	_, err = r.stow.PutObject(ctx, "bucket", "pool-0/test/00000/00001", second)
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		var mu sync.Mutex
+		var requested []string
+		provider.Fail = func(req *http.Request) error {
+			if req.Method == http.MethodGet && req.URL.Query().Get("list-type") == "" {
+				mu.Lock()
+				requested = append(requested, req.URL.Path+" "+req.Header.Get("Range"))
+				mu.Unlock()
+			}
+			return nil
+		}
+
+		r, err := newRemote(ctx, s.zed, entry, nil, s.stow...)
+		require.NoError(t, err)
+		r.budget = s.budget
+
+		var out bytes.Buffer
+		done := make(chan error, 1)
+		go func() {
+			done <- r.download([]string{"pool-0/test/00000/00000", "pool-0/test/00000/00001"}, &out)
+		}()
+
+		select {
+		case err := <-done:
+			require.NoError(t, err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("download did not complete")
+		}
+		assert.Equal(t, append(first, second...), out.Bytes())
+
+		mu.Lock()
+		assert.ElementsMatch(t, []string{
+			"/pool-0/test/00000/00000 bytes=0-7999999",
+			"/pool-0/test/00000/00000 bytes=8000000-9999999",
+			"/pool-0/test/00000/00000 bytes=10000000-11999999",
+			"/pool-0/test/00000/00001 bytes=0-2999999",
+		}, requested)
+		assert.Equal(t, "/pool-0/test/00000/00000 bytes=0-7999999", requested[0])
+		mu.Unlock()
+	}
+}
+
+func TestDownloadRanges(t *testing.T) {
+	settings := testSettings("pool-0/test")
+	r := &remote{
+		entry: settings.FileSystems["pool-0/test"].Send[0].Inherit(settings),
+		sizes: map[string]int{"pool-0/test/00000/00000": 5 * Megabyte / 2},
+	}
+
+	ranges, err := r.ranges([]string{"pool-0/test/00000/00000"})
+	require.NoError(t, err)
+	assert.Equal(t, []byteRange{
+		{"pool-0/test/00000/00000", 0, Megabyte - 1},
+		{"pool-0/test/00000/00000", Megabyte, 2*Megabyte - 1},
+		{"pool-0/test/00000/00000", 2 * Megabyte, 5*Megabyte/2 - 1},
+	}, ranges)
+
+	_, err = r.ranges([]string{"pool-0/test/00000/00001"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,83 @@
+package snapr
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"snapr/internal/zed"
+	"syscall"
+)
+
+var newlines = regexp.MustCompile(`\r?\n`)
+
+func hookEnvironment(snapshot zed.Snapshot, prefix string) []string {
+	return []string{
+		"SNAPR_FILE_SYSTEM=" + snapshot.Addr.FileSystem.String(),
+		"SNAPR_PREFIX=" + prefix,
+		"SNAPR_SNAPSHOT=" + snapshot.Addr.Name,
+	}
+}
+
+// run executes the hook using the shell. The command and any processes it started are killed if it exceeds the timeout.
+func (h Hook) run(ctx context.Context, env []string) error {
+	if h.Command == "" {
+		return nil
+	}
+
+	timeout, err := h.TimeoutDuration()
+	if err != nil {
+		return fmt.Errorf("could not parse timeout '%s': %w", h.Timeout, err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// Output is captured in a file rather than a pipe so that lingering child processes cannot delay a timeout.
+	out, err := ioutil.TempFile("", "snapr-hook")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	// The hook runs in its own process group so that any processes it starts are killed along with the shell.
+	cmd := exec.Command("/bin/sh", "-c", h.Command)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("hook '%s' failed to start (%w)", h.Command, err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err != nil {
+			Logger.Warn().Msgf("failed to kill hook '%s': %s", h.Command, err)
+		}
+		err = <-done
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("hook '%s' timed out after %s", h.Command, timeout)
+	}
+
+	if err != nil {
+		msg, _ := ioutil.ReadFile(out.Name())
+		return fmt.Errorf("hook '%s' failed: %s (%w)", h.Command, newlines.ReplaceAllString(string(msg), " "), err)
+	}
+
+	Logger.Debug().Msgf("hook '%s' succeeded", h.Command)
+	return nil
+}
@@ -0,0 +1,115 @@
+package snapr
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"snapr/internal/stow/stowtest"
+	"snapr/internal/zed"
+	"snapr/internal/zed/zedtest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHookEnvironment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapr")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	output := filepath.Join(dir, "output")
+	snapshot := zed.Snapshot{Addr: zed.Address{FileSystem: zed.FileSystem{Pool: "pool-0", Name: "test"}, Name: "daily-00001"}}
+
+	hook := Hook{Command: `echo "$SNAPR_FILE_SYSTEM $SNAPR_PREFIX $SNAPR_SNAPSHOT" > ` + output}
+	assert.NoError(t, hook.run(context.Background(), hookEnvironment(snapshot, "daily")))
+
+	content, err := ioutil.ReadFile(output)
+	assert.NoError(t, err)
+	assert.Equal(t, "pool-0/test daily daily-00001\n", string(content))
+}
+
+func TestHookFailure(t *testing.T) {
+	assert.NoError(t, Hook{}.run(context.Background(), nil))
+	assert.Error(t, Hook{Command: "exit 1"}.run(context.Background(), nil))
+	assert.Error(t, Hook{Command: "sleep 5", Timeout: "10ms"}.run(context.Background(), nil))
+	assert.Error(t, Hook{Command: "true", Timeout: "soon"}.run(context.Background(), nil))
+}
+
+func TestHookTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapr")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// The child of the shell would create the marker after the hook times out unless it is killed as well.
+	marker := filepath.Join(dir, "marker")
+	hook := Hook{Command: `(sleep 0.3; touch ` + marker + `) & wait`, Timeout: "50ms"}
+
+	start := time.Now()
+	assert.Error(t, hook.run(context.Background(), nil))
+	assert.Less(t, int64(time.Since(start)), int64(300*time.Millisecond))
+
+	time.Sleep(600 * time.Millisecond)
+	_, err = os.Stat(marker)
+	assert.True(t, os.IsNotExist(err), "the child process is killed")
+}
+
+// failingZFS fails to create snapshots.
+type failingZFS struct {
+	*zedtest.Fake
+}
+
+func (f failingZFS) CreateSnapshot(ctx context.Context, s zed.Snapshot) error {
+	return assert.AnError
+}
+
+func TestSnapHooks(t *testing.T) {
+	fs := zed.FileSystem{Pool: "pool-0", Name: "test"}
+
+	dir, err := ioutil.TempDir("", "snapr")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	status := filepath.Join(dir, "status")
+	marker := filepath.Join(dir, "marker")
+
+	snap := func(local zed.ZFS, pre string) Report {
+		os.Remove(status)
+		settings := testSettings(fs.String())
+		entries := settings.FileSystems[fs.String()]
+		entries.Snap[0].Pre = Hook{Command: pre}
+		entries.Snap[0].Post = Hook{Command: `echo "$SNAPR_SNAPSHOT $SNAPR_STATUS" > ` + status}
+		settings.FileSystems[fs.String()] = entries
+
+		s, err := New(context.Background(), settings, WithZFS(local), WithForwarder(stowtest.New(testEndpoint).Forward))
+		require.NoError(t, err)
+		return s.Snap()
+	}
+
+	posted := func() string {
+		content, err := ioutil.ReadFile(status)
+		require.NoError(t, err)
+		return string(content)
+	}
+
+	local := zedtest.New()
+	require.NoError(t, local.CreateFileSystem(fs))
+
+	// A failing pre-hook aborts the snapshot and the post-hook reports the failure.
+	assert.True(t, snap(local, "exit 1").Failed())
+	assert.Equal(t, "daily-00000 failure\n", posted())
+	listing, err := local.ListSnapshots(context.Background(), fs)
+	require.NoError(t, err)
+	assert.Empty(t, listing)
+
+	// The post-hook runs when the snapshot can't be created.
+	assert.True(t, snap(failingZFS{local}, "touch "+marker).Failed())
+	assert.Equal(t, "daily-00000 failure\n", posted())
+	_, err = os.Stat(marker)
+	assert.NoError(t, err, "the pre-hook ran")
+
+	require.NoError(t, snap(local, "true").Err())
+	assert.Equal(t, "daily-00000 success\n", posted())
+}
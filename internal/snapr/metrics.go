@@ -0,0 +1,235 @@
+package snapr
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type metricKind struct {
+	help string
+	kind string
+}
+
+// metricKinds describes each metric written by snapr.
+var metricKinds = map[string]metricKind{
+	"snapr_send_bytes":                          {"Bytes uploaded by the last successful send.", "gauge"},
+	"snapr_send_parts":                          {"Parts uploaded by the last successful send.", "gauge"},
+	"snapr_send_duration_seconds":               {"Duration of the last successful send.", "gauge"},
+	"snapr_send_throughput_bytes_per_second":    {"Throughput of the last successful send.", "gauge"},
+	"snapr_send_last_success_timestamp_seconds": {"Time of the last successful send.", "gauge"},
+	"snapr_send_failures_total":                 {"Failed sends.", "counter"},
+	"snapr_snapshots_created_total":             {"Snapshots created.", "counter"},
+	"snapr_snapshot_failures_total":             {"Snapshots which could not be created.", "counter"},
+	"snapr_snapshots_destroyed_total":           {"Expired snapshots destroyed.", "counter"},
+	"snapr_prune_failures_total":                {"Expired snapshots which could not be destroyed.", "counter"},
+}
+
+// metrics collects samples during a run and merges them into a file read by node_exporter's textfile collector. Series
+// written by earlier runs are retained and counters are accumulated. A nil instance discards all samples.
+type metrics struct {
+	mu      sync.Mutex
+	path    string
+	samples map[string]float64
+}
+
+func newMetrics(path string) *metrics {
+	if path == "" {
+		return nil
+	}
+	return &metrics{
+		path:    path,
+		samples: make(map[string]float64),
+	}
+}
+
+// series formats a metric name with labels in the Prometheus text format. Labels are given as name and value pairs.
+func series(name string, labels ...string) string {
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], value))
+	}
+	sort.Strings(pairs)
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (m *metrics) observe(name string, value float64, labels ...string) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := series(name, labels...)
+	if metricKinds[name].kind == "counter" {
+		m.samples[key] += value
+	} else {
+		m.samples[key] = value
+	}
+}
+
+func (m *metrics) recordSend(fs string, entry SendEntry, details *SendDetails, err error) {
+	labels := []string{"file_system", fs, "endpoint", entry.Endpoint, "bucket", entry.Bucket}
+	if err != nil {
+		m.observe("snapr_send_failures_total", 1, labels...)
+		return
+	}
+
+	if details == nil {
+		return
+	}
+
+	m.observe("snapr_send_bytes", float64(details.Bytes), labels...)
+	m.observe("snapr_send_parts", float64(details.Parts), labels...)
+	m.observe("snapr_send_duration_seconds", details.Duration.Seconds(), labels...)
+	if details.Duration > 0 {
+		m.observe("snapr_send_throughput_bytes_per_second", float64(details.Bytes)/details.Duration.Seconds(), labels...)
+	}
+	m.observe("snapr_send_last_success_timestamp_seconds", float64(time.Now().Unix()), labels...)
+	m.observe("snapr_send_failures_total", 0, labels...)
+}
+
+func (m *metrics) recordSnap(fs string, created, failed int) {
+	m.observe("snapr_snapshots_created_total", float64(created), "file_system", fs)
+	m.observe("snapr_snapshot_failures_total", float64(failed), "file_system", fs)
+}
+
+func (m *metrics) recordPrune(fs string, destroyed, failed int) {
+	m.observe("snapr_snapshots_destroyed_total", float64(destroyed), "file_system", fs)
+	m.observe("snapr_prune_failures_total", float64(failed), "file_system", fs)
+}
+
+// write merges the collected samples into the file. The file is replaced atomically and a lock prevents concurrent runs
+// from losing each other's samples.
+func (m *metrics) write() error {
+	if m == nil {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	lock, err := os.OpenFile(m.path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to lock metrics (%w)", err)
+	}
+	defer lock.Close()
+
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("unable to lock metrics (%w)", err)
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	merged, err := readMetrics(m.path)
+	if err != nil {
+		return err
+	}
+
+	for key, value := range m.samples {
+		name := key[:strings.Index(key, "{")]
+		if metricKinds[name].kind == "counter" {
+			merged[key] += value
+		} else {
+			merged[key] = value
+		}
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(m.path), ".snapr-metrics-")
+	if err != nil {
+		return fmt.Errorf("unable to write metrics (%w)", err)
+	}
+	defer os.Remove(f.Name())
+
+	w := bufio.NewWriter(f)
+	writeMetrics(w, merged)
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to write metrics (%w)", err)
+	}
+
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to write metrics (%w)", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("unable to write metrics (%w)", err)
+	}
+
+	if err := os.Rename(f.Name(), m.path); err != nil {
+		return fmt.Errorf("unable to write metrics (%w)", err)
+	}
+
+	m.samples = make(map[string]float64)
+	return nil
+}
+
+// readMetrics parses the samples from an existing file. Comments are discarded as they are rewritten.
+func readMetrics(path string) (map[string]float64, error) {
+	samples := make(map[string]float64)
+
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return samples, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read metrics (%w)", err)
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(string(raw)))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		split := strings.LastIndex(line, " ")
+		if split < 0 || !strings.Contains(line[:split], "{") {
+			continue
+		}
+
+		value, err := strconv.ParseFloat(line[split+1:], 64)
+		if err != nil {
+			continue
+		}
+		samples[line[:split]] = value
+	}
+	return samples, nil
+}
+
+func writeMetrics(w *bufio.Writer, samples map[string]float64) {
+	names := make(map[string][]string)
+	for key := range samples {
+		name := key[:strings.Index(key, "{")]
+		names[name] = append(names[name], key)
+	}
+
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	for _, name := range sorted {
+		if kind, ok := metricKinds[name]; ok {
+			fmt.Fprintf(w, "# HELP %s %s\n", name, kind.help)
+			fmt.Fprintf(w, "# TYPE %s %s\n", name, kind.kind)
+		}
+
+		keys := names[name]
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(w, "%s %s\n", key, strconv.FormatFloat(samples[key], 'g', -1, 64))
+		}
+	}
+}
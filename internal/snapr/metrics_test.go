@@ -0,0 +1,91 @@
+package snapr
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"snapr/internal/stow"
+	"snapr/internal/stow/stowtest"
+	"snapr/internal/zed"
+	"snapr/internal/zed/zedtest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSeries(t *testing.T) {
+	assert.Equal(t, `snapr_send_bytes{bucket="b\"1",file_system="pool-0/test"}`, series("snapr_send_bytes", "file_system", "pool-0/test", "bucket", `b"1`))
+}
+
+func TestMetrics(t *testing.T) {
+	fs := zed.FileSystem{Pool: "pool-0", Name: "test"}
+	dir, err := ioutil.TempDir("", "snapr")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "snapr.prom")
+
+	local := zedtest.New()
+	testClock(local)
+	require.NoError(t, local.CreateFileSystem(fs))
+	require.NoError(t, local.Write(fs, testData(1, 100)))
+
+	provider := stowtest.New(testEndpoint)
+	settings := testSettings(fs.String())
+	settings.Metrics = path
+
+	s := testSnapr(t, local, provider, settings)
+	s.Snap()
+	s.Send()
+
+	samples, err := readMetrics(path)
+	require.NoError(t, err)
+
+	labels := []string{"file_system", "pool-0/test", "endpoint", testEndpoint, "bucket", "bucket"}
+	assert.Equal(t, float64(1), samples[series("snapr_snapshots_created_total", "file_system", "pool-0/test")])
+	assert.Equal(t, float64(0), samples[series("snapr_snapshot_failures_total", "file_system", "pool-0/test")])
+	assert.Equal(t, float64(0), samples[series("snapr_send_failures_total", labels...)])
+	assert.Greater(t, samples[series("snapr_send_bytes", labels...)], float64(100))
+	assert.Equal(t, float64(1), samples[series("snapr_send_parts", labels...)])
+	assert.Greater(t, samples[series("snapr_send_last_success_timestamp_seconds", labels...)], float64(0))
+
+	// A later run accumulates counters and retains the gauges of earlier runs.
+	provider.Fail = func(req *http.Request) error {
+		if req.Method == http.MethodPut {
+			return &stow.StatusError{Description: "request failed", StatusCode: http.StatusForbidden}
+		}
+		return nil
+	}
+
+	require.NoError(t, local.Write(fs, testData(2, 100)))
+	s = testSnapr(t, local, provider, settings)
+	s.Snap()
+	s.Send()
+
+	samples, err = readMetrics(path)
+	require.NoError(t, err)
+	assert.Equal(t, float64(2), samples[series("snapr_snapshots_created_total", "file_system", "pool-0/test")])
+	assert.Equal(t, float64(1), samples[series("snapr_send_failures_total", labels...)])
+	assert.Greater(t, samples[series("snapr_send_bytes", labels...)], float64(100))
+
+	raw, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(raw), "# TYPE snapr_send_failures_total counter\n")
+	assert.Equal(t, 1, strings.Count(string(raw), "# TYPE snapr_send_bytes gauge\n"))
+
+	// Pruning records the snapshots destroyed. The newest archived snapshot and the held snapshot are retained.
+	entries := settings.FileSystems[fs.String()]
+	entries.Snap[0].Retain = Retention{Last: 1}
+	settings.FileSystems[fs.String()] = entries
+	require.NoError(t, testSnapr(t, local, provider, settings).Prune().Err())
+
+	samples, err = readMetrics(path)
+	require.NoError(t, err)
+	destroyed, ok := samples[series("snapr_snapshots_destroyed_total", "file_system", "pool-0/test")]
+	assert.True(t, ok)
+	assert.Equal(t, float64(0), destroyed)
+	assert.Equal(t, float64(0), samples[series("snapr_prune_failures_total", "file_system", "pool-0/test")])
+}
@@ -0,0 +1,259 @@
+package snapr
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// notification is the summary of a run sent to webhooks and by email.
+type notification struct {
+	Host        string                   `json:"host"`
+	Operation   string                   `json:"operation"`
+	Success     bool                     `json:"success"`
+	FileSystems []fileSystemNotification `json:"fileSystems"`
+}
+
+type fileSystemNotification struct {
+	FileSystem string               `json:"fileSystem"`
+	Success    bool                 `json:"success"`
+	Results    []resultNotification `json:"results"`
+}
+
+type resultNotification struct {
+	Destination string `json:"destination,omitempty"`
+	Detail      string `json:"detail,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+func newNotification(report Report) notification {
+	host, _ := os.Hostname()
+	n := notification{Host: host, Operation: report.Operation, Success: true, FileSystems: make([]fileSystemNotification, 0)}
+
+	grouped := make(map[string]*fileSystemNotification)
+	for _, v := range report.Results {
+		fs, ok := grouped[v.FileSystem]
+		if !ok {
+			fs = &fileSystemNotification{FileSystem: v.FileSystem, Success: true}
+			grouped[v.FileSystem] = fs
+		}
+
+		o := resultNotification{Destination: v.Destination, Detail: v.Detail}
+		if v.Err != nil {
+			o.Error = v.Err.Error()
+			fs.Success = false
+			n.Success = false
+		}
+		fs.Results = append(fs.Results, o)
+	}
+
+	for _, v := range grouped {
+		n.FileSystems = append(n.FileSystems, *v)
+	}
+	sort.Slice(n.FileSystems, func(i, j int) bool {
+		return n.FileSystems[i].FileSystem < n.FileSystems[j].FileSystem
+	})
+	return n
+}
+
+func (n notification) subject() string {
+	status := "succeeded"
+	if !n.Success {
+		status = "failed"
+	}
+	return fmt.Sprintf("snapr %s %s on %s", n.Operation, status, n.Host)
+}
+
+func (n notification) String() string {
+	var sb strings.Builder
+	for _, fs := range n.FileSystems {
+		status := "ok"
+		if !fs.Success {
+			status = "failed"
+		}
+		sb.WriteString(fmt.Sprintf("%s: %s\n", fs.FileSystem, status))
+
+		for _, v := range fs.Results {
+			sb.WriteString("  ")
+			if v.Destination != "" {
+				sb.WriteString(v.Destination + ": ")
+			}
+			if v.Error != "" {
+				sb.WriteString("error: " + v.Error)
+			} else {
+				sb.WriteString(v.Detail)
+			}
+			sb.WriteString("\n")
+		}
+	}
+	return sb.String()
+}
+
+// notify sends a summary of the report to the configured webhook and email recipients. Nothing is sent if there are no
+// results or, unless notifying always, if nothing failed. Each channel is given its own timeout and isn't bound to the
+// run, so a run which was interrupted is still notified.
+func (s NotifySettings) notify(report Report) error {
+	if len(report.Results) == 0 || (s.Webhook.URL == "" && s.Email.Host == "") {
+		return nil
+	}
+
+	n := newNotification(report)
+	if n.Success && s.On != NotifyAlways {
+		return nil
+	}
+
+	// Each channel is attempted regardless of the other failing so one can stand in for the other.
+	messages := make([]string, 0)
+	if s.Webhook.URL != "" {
+		if err := attempt(func(ctx context.Context) error { return s.Webhook.post(ctx, n) }); err != nil {
+			messages = append(messages, err.Error())
+		}
+	}
+
+	if s.Email.Host != "" {
+		if err := attempt(func(ctx context.Context) error { return s.Email.send(ctx, n) }); err != nil {
+			messages = append(messages, err.Error())
+		}
+	}
+
+	if len(messages) > 0 {
+		return errors.New(strings.Join(messages, "; "))
+	}
+	return nil
+}
+
+// attempt runs a notification channel within the notification timeout.
+func attempt(channel func(context.Context) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), NotifyTimeout)
+	defer cancel()
+	return channel(ctx)
+}
+
+func (w Webhook) post(ctx context.Context, n notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to notify '%s' (%w)", w.URL, err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.Headers {
+		req.Header.Set(k, v)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to notify '%s' (%w)", w.URL, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("failed to notify '%s': %s", w.URL, res.Status)
+	}
+	return nil
+}
+
+// send emails the notification. The connection is bound by the context's deadline as the SMTP client has no timeouts of
+// its own.
+func (e Email) send(ctx context.Context, n notification) error {
+	port := e.Port
+	if port == 0 {
+		port = 25
+	}
+	address := net.JoinHostPort(e.Host, strconv.Itoa(port))
+
+	var auth smtp.Auth
+	if e.Username != "" {
+		auth = smtp.PlainAuth("", e.Username, e.Password, e.Host)
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", e.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(e.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", n.subject())
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(n.String(), "\n", "\r\n"))
+
+	if err := e.deliver(ctx, address, auth, msg.Bytes()); err != nil {
+		return fmt.Errorf("failed to email '%s' (%w)", strings.Join(e.To, ", "), err)
+	}
+	return nil
+}
+
+// deliver performs the steps of smtp.SendMail over a connection dialled with the context.
+func (e Email) deliver(ctx context.Context, address string, auth smtp.Auth, msg []byte) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return err
+		}
+	}
+
+	c, err := smtp.NewClient(conn, e.Host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: e.Host}); err != nil {
+			return err
+		}
+	}
+
+	if auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("server doesn't support AUTH")
+		}
+
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(e.From); err != nil {
+		return err
+	}
+
+	for _, v := range e.To {
+		if err := c.Rcpt(v); err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
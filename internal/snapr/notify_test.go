@@ -0,0 +1,237 @@
+package snapr
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"snapr/internal/stow"
+	"snapr/internal/stow/stowtest"
+	"snapr/internal/zed"
+	"snapr/internal/zed/zedtest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNotifyWebhook(t *testing.T) {
+	fs := zed.FileSystem{Pool: "pool-0", Name: "test"}
+
+	received := make([]notification, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "secret", r.Header.Get("Authorization"))
+
+		var n notification
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&n))
+		received = append(received, n)
+	}))
+	defer server.Close()
+
+	local := zedtest.New()
+	testClock(local)
+	require.NoError(t, local.CreateFileSystem(fs))
+	require.NoError(t, local.Write(fs, testData(1, 100)))
+
+	provider := stowtest.New(testEndpoint)
+	settings := testSettings(fs.String())
+	settings.Notify.Webhook = Webhook{URL: server.URL, Headers: map[string]string{"Authorization": "secret"}}
+
+	s := testSnapr(t, local, provider, settings)
+
+	// Successful runs are only notified when notifying always.
+	s.Snap()
+	assert.Empty(t, received)
+
+	settings.Notify.On = NotifyAlways
+	s.Send()
+	require.Len(t, received, 1)
+	assert.Equal(t, "send", received[0].Operation)
+	assert.True(t, received[0].Success)
+	require.Len(t, received[0].FileSystems, 1)
+	assert.Equal(t, fs.String(), received[0].FileSystems[0].FileSystem)
+	assert.Equal(t, testEndpoint+"/bucket", received[0].FileSystems[0].Results[0].Destination)
+
+	// Failures are always notified.
+	settings.Notify.On = ""
+	provider.Fail = func(*http.Request) error {
+		return &stow.StatusError{StatusCode: http.StatusForbidden}
+	}
+	require.NoError(t, local.Write(fs, testData(2, 100)))
+	s.Snap()
+	s.Send()
+	require.Len(t, received, 2)
+	assert.False(t, received[1].Success)
+	assert.False(t, received[1].FileSystems[0].Success)
+	assert.NotEmpty(t, received[1].FileSystems[0].Results[0].Error)
+}
+
+func TestNotifyEmail(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	messages := make(chan string, 1)
+	go fakeSMTP(listener, messages)
+
+	host, port, err := net.SplitHostPort(listener.Addr().String())
+	require.NoError(t, err)
+	number, err := strconv.Atoi(port)
+	require.NoError(t, err)
+
+	settings := NotifySettings{
+		Email: Email{Host: host, Port: number, From: "snapr@example.com", To: []string{"admin@example.com"}},
+	}
+
+	report := Report{Operation: "snap", Results: []Result{
+		{FileSystem: "pool-0/first", Detail: "created pool-0/first@daily-00001"},
+		{FileSystem: "pool-0/second", Err: assert.AnError},
+	}}
+	require.NoError(t, settings.notify(report))
+
+	message := <-messages
+	assert.Contains(t, message, "To: admin@example.com")
+	assert.Contains(t, message, "Subject: snapr snap failed on ")
+	assert.Contains(t, message, "pool-0/first: ok")
+	assert.Contains(t, message, "pool-0/second: failed")
+	assert.Contains(t, message, assert.AnError.Error())
+}
+
+func TestNotifyFallback(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	messages := make(chan string, 1)
+	go fakeSMTP(listener, messages)
+
+	host, port, err := net.SplitHostPort(listener.Addr().String())
+	require.NoError(t, err)
+	number, err := strconv.Atoi(port)
+	require.NoError(t, err)
+
+	settings := NotifySettings{
+		Webhook: Webhook{URL: server.URL},
+		Email:   Email{Host: host, Port: number, From: "snapr@example.com", To: []string{"admin@example.com"}},
+	}
+
+	// The email is sent although the webhook failed.
+	report := Report{Operation: "send", Results: []Result{{FileSystem: "pool-0/test", Err: assert.AnError}}}
+	err = settings.notify(report)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), server.URL)
+	assert.Contains(t, <-messages, "pool-0/test: failed")
+}
+
+func TestNotifyEmailTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	// The server accepts connections but never responds.
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	host, port, err := net.SplitHostPort(listener.Addr().String())
+	require.NoError(t, err)
+	number, err := strconv.Atoi(port)
+	require.NoError(t, err)
+
+	email := Email{Host: host, Port: number, From: "snapr@example.com", To: []string{"admin@example.com"}}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- email.send(ctx, newNotification(Report{Operation: "snap"}))
+	}()
+
+	select {
+	case err := <-done:
+		assert.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("email did not time out")
+	}
+}
+
+// fakeSMTP accepts a single message and forwards it to messages.
+func fakeSMTP(listener net.Listener, messages chan<- string) {
+	conn, err := listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 localhost ESMTP")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+
+		switch command := strings.ToUpper(strings.Fields(line)[0]); command {
+		case "EHLO", "HELO":
+			tp.PrintfLine("250 localhost")
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			raw, err := ioutil.ReadAll(bufio.NewReader(tp.DotReader()))
+			if err != nil {
+				return
+			}
+			messages <- string(raw)
+			tp.PrintfLine("250 ok")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("250 ok")
+		}
+	}
+}
+
+func TestNotifyInterrupted(t *testing.T) {
+	received := make(chan notification, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n notification
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&n))
+		received <- n
+	}))
+	defer server.Close()
+
+	settings := testSettings("pool-0/test")
+	settings.Notify.Webhook = Webhook{URL: server.URL}
+
+	// A run which was cancelled is still notified.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s, err := New(ctx, settings, WithZFS(zedtest.New()))
+	require.NoError(t, err)
+
+	s.notify(Report{Operation: "send", Results: []Result{{FileSystem: "pool-0/test", Err: context.Canceled}}})
+	select {
+	case n := <-received:
+		assert.False(t, n.Success)
+	default:
+		t.Fatal("the interrupted run was not notified")
+	}
+}
@@ -0,0 +1,28 @@
+package snapr
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// plan records the operations a dry run would perform.
+type plan struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// add writes an operation to the plan. Details of the operation are indented beneath it.
+func (p *plan) add(operation string, details ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	fmt.Fprintln(p.out, operation)
+	for _, v := range details {
+		fmt.Fprintln(p.out, "  "+v)
+	}
+}
+
+func formatSize(bytes int64) string {
+	return fmt.Sprintf("%.2f MB", float64(bytes)/Megabyte)
+}
@@ -0,0 +1,281 @@
+package snapr
+
+import (
+	"context"
+	"fmt"
+	"snapr/internal/stow"
+	"snapr/internal/zed"
+	"time"
+)
+
+type pruner struct {
+	ctx      context.Context
+	zed      zed.ZFS
+	settings *Settings
+	stow     []stow.SetOption
+	plan     *plan
+	metrics  *metrics
+}
+
+func (s *Snapr) newPruner() *pruner {
+	return &pruner{
+		ctx:      s.ctx,
+		zed:      s.zed,
+		settings: s.settings,
+		stow:     s.stow,
+		plan:     s.plan,
+		metrics:  s.metrics,
+	}
+}
+
+// Prune destroys snapshots which are no longer retained as per configuration. A result is returned for each snapshot
+// destroyed or which failed.
+func (p *pruner) Prune() []Result {
+	results := make([]Result, 0)
+
+	for target, settings := range p.settings.FileSystems {
+		if !retains(settings.Snap) {
+			Logger.Debug().Msgf("skipping prune on '%s': no retention", target)
+			continue
+		}
+		results = append(results, p.pruneFileSystem(target, settings)...)
+	}
+	return results
+}
+
+// pruneFileSystem destroys the expired snapshots of a single file system. A file system which can't be pruned is
+// reported as a single failure.
+func (p *pruner) pruneFileSystem(target string, settings FileSystemSettings) []Result {
+	fs, err := zed.ToFileSystem(target)
+	if err != nil {
+		Logger.Warn().Msgf("skipping prune on '%s': failed parsing file system (%s)", target, err)
+		return []Result{{FileSystem: target, Err: err}}
+	}
+
+	results, err := p.prune(*fs, settings)
+	if err != nil {
+		Logger.Warn().Msgf("skipping prune on '%s': %s", target, err)
+		results = append(results, Result{FileSystem: target, Err: err})
+	}
+
+	if p.plan == nil {
+		destroyed, failed := 0, 0
+		for _, v := range results {
+			if v.Err != nil {
+				failed++
+			} else {
+				destroyed++
+			}
+		}
+		p.metrics.recordPrune(target, destroyed, failed)
+	}
+	return results
+}
+
+func (p *pruner) prune(fs zed.FileSystem, settings FileSystemSettings) ([]Result, error) {
+	protected, err := p.protected(fs, settings.Send)
+	if err != nil {
+		return nil, fmt.Errorf("unable to determine archived snapshots (%w)", err)
+	}
+
+	listing, err := p.zed.ListSnapshots(p.ctx, fs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots for '%s': %w", fs, err)
+	}
+
+	results := make([]Result, 0)
+	for _, entry := range settings.Snap {
+		if !entry.Retain.Active() {
+			continue
+		}
+
+		now := time.Now()
+		expired, err := expire(fs, entry, listing, protected, now)
+		if err != nil {
+			Logger.Warn().Msgf("skipping prune of '%s' on '%s': %s", entry.Prefix, fs, err)
+			results = append(results, Result{FileSystem: fs.String(), Err: err})
+			continue
+		}
+		results = append(results, p.destroy(fs, expired)...)
+
+		if entry.Recursive {
+			results = append(results, p.pruneDescendants(fs, entry, listing, protected, now)...)
+		}
+	}
+	return results, nil
+}
+
+// pruneDescendants destroys the expired snapshots a recursive entry created on the descendants of the file system. Each
+// descendant is expired on its own so its held snapshots are kept. A snapshot sharing its name with an archived snapshot
+// of the file system is protected as the archive includes the descendants.
+func (p *pruner) pruneDescendants(fs zed.FileSystem, entry SnapEntry, listing []zed.SnapshotListing, protected map[string]bool, now time.Time) []Result {
+	children, err := p.zed.ListFileSystems(p.ctx, fs)
+	if err != nil {
+		return []Result{{FileSystem: fs.String(), Err: fmt.Errorf("failed to list descendants of '%s': %w", fs, err)}}
+	}
+
+	snapshots, err := descendants(zed.Snapshot{Addr: zed.Address{FileSystem: fs}}, children, entry.Exclude)
+	if err != nil {
+		return []Result{{FileSystem: fs.String(), Err: err}}
+	}
+
+	archived := make(map[string]bool)
+	for _, v := range listing {
+		if protected[v.Identity] {
+			archived[v.Snapshot.Addr.Name] = true
+		}
+	}
+
+	results := make([]Result, 0)
+	for _, v := range snapshots {
+		child := v.Addr.FileSystem
+		if child == fs {
+			continue
+		}
+
+		childListing, err := p.zed.ListSnapshots(p.ctx, child)
+		if err != nil {
+			results = append(results, Result{FileSystem: fs.String(), Err: fmt.Errorf("failed to list snapshots for '%s': %w", child, err)})
+			continue
+		}
+
+		guarded := make(map[string]bool)
+		for _, v := range childListing {
+			if archived[v.Snapshot.Addr.Name] {
+				guarded[v.Identity] = true
+			}
+		}
+
+		expired, err := expire(child, entry, childListing, guarded, now)
+		if err != nil {
+			results = append(results, Result{FileSystem: fs.String(), Err: err})
+			continue
+		}
+		results = append(results, p.destroy(fs, expired)...)
+	}
+	return results
+}
+
+// destroy destroys the expired snapshots. A result is returned for each snapshot reported against the file system.
+func (p *pruner) destroy(fs zed.FileSystem, expired []zed.Snapshot) []Result {
+	results := make([]Result, 0, len(expired))
+	for _, snapshot := range expired {
+		if p.plan != nil {
+			p.plan.add(fmt.Sprintf("destroy %s", snapshot.Address()))
+			results = append(results, Result{FileSystem: fs.String(), Detail: fmt.Sprintf("destroyed %s", snapshot.Address())})
+			continue
+		}
+
+		if err := p.zed.Destroy(p.ctx, snapshot); err != nil {
+			Logger.Warn().Msgf("failed destroying snapshot '%s': %s", snapshot.Address(), err)
+			results = append(results, Result{FileSystem: fs.String(), Err: fmt.Errorf("failed destroying snapshot '%s' (%w)", snapshot.Address(), err)})
+			continue
+		}
+		Logger.Info().Msgf("destroyed snapshot '%s'", snapshot.Address())
+		results = append(results, Result{FileSystem: fs.String(), Detail: fmt.Sprintf("destroyed %s", snapshot.Address())})
+	}
+	return results
+}
+
+// protected collects the identity of the newest archived snapshot for each destination.
+func (p *pruner) protected(fs zed.FileSystem, entries []SendEntry) (map[string]bool, error) {
+	identities := make(map[string]bool)
+	for _, entry := range entries {
+		remote, err := newRemote(p.ctx, p.zed, entry.Inherit(p.settings), nil, p.stow...)
+		if err != nil {
+			return nil, err
+		}
+
+		identity, err := remote.lastIdentity(fs)
+		if err != nil {
+			return nil, err
+		}
+
+		if identity != "" {
+			identities[identity] = true
+		}
+	}
+	return identities, nil
+}
+
+func retains(entries []SnapEntry) bool {
+	for _, entry := range entries {
+		if entry.Retain.Active() {
+			return true
+		}
+	}
+	return false
+}
+
+type period struct {
+	count int
+	key   func(time.Time) string
+}
+
+func (r Retention) periods() []period {
+	return []period{
+		{r.Hourly, func(t time.Time) string { return t.Format("2006-01-02T15") }},
+		{r.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{r.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{r.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+		{r.Yearly, func(t time.Time) string { return t.Format("2006") }},
+	}
+}
+
+// expire determines which snapshots created by the entry are no longer retained. Held and protected snapshots are never expired.
+func expire(fs zed.FileSystem, entry SnapEntry, listing []zed.SnapshotListing, protected map[string]bool, now time.Time) ([]zed.Snapshot, error) {
+	template, err := entry.template()
+	if err != nil {
+		return nil, err
+	}
+
+	within, err := entry.Retain.WithinDuration()
+	if err != nil {
+		return nil, fmt.Errorf("could not parse within '%s': %w", entry.Retain.Within, err)
+	}
+
+	candidates := make([]zed.SnapshotListing, 0)
+	for i := len(listing) - 1; i >= 0; i-- {
+		v := listing[i]
+		if v.Snapshot.Addr.FileSystem == fs && template.matches(v.Snapshot.Addr.Name) {
+			candidates = append(candidates, v)
+		}
+	}
+
+	kept := make([]bool, len(candidates))
+	for i, v := range candidates {
+		if i < entry.Retain.Last {
+			kept[i] = true
+		}
+		if within > 0 && v.Created.After(now.Add(-within)) {
+			kept[i] = true
+		}
+	}
+
+	for _, p := range entry.Retain.periods() {
+		seen := make(map[string]bool)
+		for i, v := range candidates {
+			if len(seen) >= p.count {
+				break
+			}
+			key := p.key(v.Created.Local())
+			if !seen[key] {
+				seen[key] = true
+				kept[i] = true
+			}
+		}
+	}
+
+	expired := make([]zed.Snapshot, 0)
+	for i := len(candidates) - 1; i >= 0; i-- {
+		v := candidates[i]
+		if kept[i] || len(v.Holds) > 0 || protected[v.Identity] {
+			continue
+		}
+		expired = append(expired, v.Snapshot)
+	}
+	return expired, nil
+}
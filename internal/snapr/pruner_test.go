@@ -0,0 +1,138 @@
+package snapr
+
+import (
+	"context"
+	"fmt"
+	"snapr/internal/stow/stowtest"
+	"snapr/internal/zed"
+	"snapr/internal/zed/zedtest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func dailyListing(fs zed.FileSystem, latest time.Time, count int) []zed.SnapshotListing {
+	listing := make([]zed.SnapshotListing, 0, count)
+	for i := 0; i < count; i++ {
+		listing = append(listing, zed.SnapshotListing{
+			Snapshot: zed.Snapshot{Addr: zed.Address{FileSystem: fs, Name: "daily-" + padNumber(i)}},
+			Created:  latest.AddDate(0, 0, i-count+1),
+			Identity: fmt.Sprintf("%d", i),
+		})
+	}
+	return listing
+}
+
+func TestExpireLast(t *testing.T) {
+	fs := zed.FileSystem{Pool: "pool-0", Name: "test"}
+	now := time.Date(2021, time.October, 6, 21, 11, 0, 0, time.Local)
+
+	listing := dailyListing(fs, now, 5)
+	listing = append(listing, zed.SnapshotListing{
+		Snapshot: zed.Snapshot{Addr: zed.Address{FileSystem: fs, Name: "out-of-band"}},
+		Created:  now,
+	})
+
+	entry := SnapEntry{Prefix: "daily", Retain: Retention{Last: 2}}
+	expired, err := expire(fs, entry, listing, map[string]bool{}, now)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []zed.Snapshot{
+		listing[0].Snapshot,
+		listing[1].Snapshot,
+		listing[2].Snapshot,
+	}, expired)
+}
+
+func TestExpireWithin(t *testing.T) {
+	fs := zed.FileSystem{Pool: "pool-0", Name: "test"}
+	now := time.Date(2021, time.October, 6, 21, 11, 0, 0, time.Local)
+
+	listing := dailyListing(fs, now, 5)
+
+	entry := SnapEntry{Prefix: "daily", Retain: Retention{Within: "50h"}}
+	expired, err := expire(fs, entry, listing, map[string]bool{}, now)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []zed.Snapshot{listing[0].Snapshot, listing[1].Snapshot}, expired)
+}
+
+func TestExpireBuckets(t *testing.T) {
+	fs := zed.FileSystem{Pool: "pool-0", Name: "test"}
+	now := time.Date(2021, time.October, 6, 21, 11, 0, 0, time.Local)
+
+	listing := dailyListing(fs, now, 40)
+
+	entry := SnapEntry{Prefix: "daily", Retain: Retention{Daily: 3, Monthly: 3}}
+	expired, err := expire(fs, entry, listing, map[string]bool{}, now)
+
+	assert.NoError(t, err)
+	assert.Len(t, expired, 35)
+	assert.NotContains(t, expired, listing[39].Snapshot)
+	assert.NotContains(t, expired, listing[38].Snapshot)
+	assert.NotContains(t, expired, listing[37].Snapshot)
+	assert.NotContains(t, expired, listing[33].Snapshot, "last of September")
+	assert.NotContains(t, expired, listing[3].Snapshot, "last of August")
+}
+
+func TestExpireHeldAndProtected(t *testing.T) {
+	fs := zed.FileSystem{Pool: "pool-0", Name: "test"}
+	now := time.Date(2021, time.October, 6, 21, 11, 0, 0, time.Local)
+
+	listing := dailyListing(fs, now, 4)
+	listing[0].Holds = []string{"aws"}
+
+	entry := SnapEntry{Prefix: "daily", Retain: Retention{Last: 1}}
+	expired, err := expire(fs, entry, listing, map[string]bool{listing[1].Identity: true}, now)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []zed.Snapshot{listing[2].Snapshot}, expired)
+}
+
+func TestPruneRecursive(t *testing.T) {
+	fs := zed.FileSystem{Pool: "pool-0", Name: "test"}
+	child := zed.FileSystem{Pool: "pool-0", Name: "test/child"}
+	ctx := context.Background()
+
+	local := zedtest.New()
+	testClock(local)
+	require.NoError(t, local.CreateFileSystem(fs))
+	require.NoError(t, local.CreateFileSystem(child))
+
+	settings := testSettings(fs.String())
+	entries := settings.FileSystems[fs.String()]
+	entries.Snap[0].Hold = nil
+	entries.Snap[0].Recursive = true
+	entries.Snap[0].Retain = Retention{Last: 1}
+	settings.FileSystems[fs.String()] = entries
+
+	provider := stowtest.New(testEndpoint)
+	s := testSnapr(t, local, provider, settings)
+
+	for i := 0; i < 4; i++ {
+		require.NoError(t, local.Write(fs, testData(byte(i), 100)))
+		require.NoError(t, s.Snap().Err())
+		if i == 1 {
+			require.NoError(t, s.Send().Err())
+		}
+	}
+	require.NoError(t, local.HoldSnapshot(ctx, zed.Snapshot{Addr: zed.Address{FileSystem: child, Name: "daily-00000"}}, "keep"))
+
+	require.NoError(t, s.Prune().Err())
+
+	names := func(fs zed.FileSystem) []string {
+		listing, err := local.ListSnapshots(ctx, fs)
+		require.NoError(t, err)
+
+		names := make([]string, 0)
+		for _, v := range listing {
+			names = append(names, v.Snapshot.Addr.Name)
+		}
+		return names
+	}
+
+	assert.Equal(t, []string{"daily-00001", "daily-00003"}, names(fs))
+	assert.Equal(t, []string{"daily-00000", "daily-00001", "daily-00003"}, names(child), "held and archived snapshots of descendants are kept")
+}
@@ -3,6 +3,7 @@ package snapr
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"regexp"
@@ -14,27 +15,43 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
+// errUpToDate indicates there are no new snapshots to send.
+var errUpToDate = errors.New("remote is up to date")
+
 var splitPath = regexp.MustCompile(`^(?P<fs>[^\/]*\/[^\/]*)\/(?P<archive>\d+)\/(?P<volume>\d+)$`)
 
 type remote struct {
 	ctx       context.Context
-	zed       *zed.Zed
+	zed       zed.ZFS
 	stow      *stow.Stow
 	entry     SendEntry
 	catalogue catalogue
+	sizes     map[string]int
+	plan      *plan
+	budget    *budget
+	resume    string
 }
 
-func newRemote(ctx context.Context, zed *zed.Zed, entry SendEntry) (*remote, error) {
-	stow, err := entry.NewStow()
+// newRemote lists the bucket to build a catalogue. When a plan is given sends and restores are recorded in the plan
+// rather than performed.
+func newRemote(ctx context.Context, zed zed.ZFS, entry SendEntry, plan *plan, options ...stow.SetOption) (*remote, error) {
+	stow, err := entry.NewStow(options...)
 	if err != nil {
 		return nil, err
 	}
 
-	listing, err := stow.ListAllKeys(ctx, entry.Bucket)
+	objects, err := stow.ListAllObjects(ctx, entry.Bucket)
 	if err != nil {
 		return nil, err
 	}
 
+	listing := make([]string, 0, len(objects.Objects))
+	sizes := make(map[string]int, len(objects.Objects))
+	for _, v := range objects.Objects {
+		listing = append(listing, v.Key)
+		sizes[v.Key] = v.Size
+	}
+
 	catalogue := make(catalogue)
 	catalogue.load(listing)
 
@@ -44,193 +61,718 @@ func newRemote(ctx context.Context, zed *zed.Zed, entry SendEntry) (*remote, err
 		stow:      stow,
 		entry:     entry,
 		catalogue: catalogue,
+		sizes:     sizes,
+		plan:      plan,
 	}, nil
 }
 
-func (r *remote) restore(fs zed.FileSystem) error {
+// restore receives the archives of the file system into the target up to the restore point. Archives already present in
+// the target are skipped so a restore which was interrupted can be retried to continue from the archive which failed.
+// The archives are received using the receive options.
+func (r *remote) restore(fs, target zed.FileSystem, options RestoreOptions, receive zed.ReceiveOptions) error {
 	paths, err := r.catalogue.verify(fs.String())
 	if err != nil {
 		return err
 	}
 
-	Logger.Info().Msgf("restoring %s from %s", fs, r.entry.Bucket)
+	end, rollback, err := r.restorePoint(fs, target, paths, options)
+	if err != nil {
+		return err
+	}
+
+	start, err := r.received(fs, target, paths)
+	if err != nil {
+		return err
+	}
+
+	if start > end+1 {
+		return fmt.Errorf("%s already contains archive %d which is after the restore point", target, start-1)
+	}
+	paths = paths[:end+1]
+
+	if r.plan != nil {
+		if err := r.planRestore(fs, target, paths, start); err != nil {
+			return err
+		}
+		return r.rollback(target, rollback, options.Rollback)
+	}
+
+	if len(paths) > 0 && start == len(paths) {
+		Logger.Info().Msgf("%s is up to date with %s", target, r.entry.Bucket)
+	} else {
+		Logger.Info().Msgf("restoring %s from %s into %s", fs, r.entry.Bucket, target)
+	}
+
+	for i := start; i < len(paths); i++ {
+		err := r.restoreVolume(target, receiveInto(fs, target, receive.Discard), i, paths[i], receive)
+		if err != nil {
+			return fmt.Errorf("failed to restore %s (%w)", target, err)
+		}
+	}
+	return r.rollback(target, rollback, options.Rollback)
+}
+
+// restorePoint determines the last archive to receive. If the requested snapshot isn't the newest in its archive the
+// snapshot is also returned as later snapshots in the archive are received with it.
+func (r *remote) restorePoint(fs, target zed.FileSystem, paths [][]string, point RestoreOptions) (int, *zed.Snapshot, error) {
+	if point.Snapshot == "" {
+		if point.Archive < 0 {
+			return len(paths) - 1, nil, nil
+		}
+
+		if point.Archive >= len(paths) {
+			return 0, nil, fmt.Errorf("archive %d of %s does not exist in %s", point.Archive, fs, r.entry.Bucket)
+		}
+		return point.Archive, nil, nil
+	}
+
+	// An incremental archive begins with the newest snapshot of the previous archive so the first match is used.
+	for i := range paths {
+		entries, err := r.contents(fs, i)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		for j, v := range entries {
+			if v.Name != point.Snapshot {
+				continue
+			}
+
+			if j == len(entries)-1 {
+				return i, nil, nil
+			}
+			return i, &zed.Snapshot{Addr: zed.Address{FileSystem: target, Name: v.Name}}, nil
+		}
+	}
+	return 0, nil, fmt.Errorf("snapshot '%s' of %s is not archived in %s", point.Snapshot, fs, r.entry.Bucket)
+}
+
+// rollback reverts the file system to a snapshot received part way through an archive. The holds on later snapshots
+// are released so they can be destroyed. Unless enabled the snapshot is only reported.
+func (r *remote) rollback(fs zed.FileSystem, snapshot *zed.Snapshot, enabled bool) error {
+	if snapshot == nil {
+		return nil
+	}
+
+	if !enabled {
+		Logger.Warn().Msgf("%s is not the newest snapshot of its archive so later snapshots were also received: use --rollback or 'zfs rollback -r %s' to revert to it", snapshot.Address(), snapshot.Address())
+		return nil
+	}
+
+	if r.plan != nil {
+		r.plan.add(fmt.Sprintf("roll back %s to %s", fs, snapshot.Address()))
+		return nil
+	}
+
+	listing, err := r.zed.ListSnapshots(r.ctx, fs)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, v := range listing {
+		if found {
+			for _, tag := range v.Holds {
+				if err := r.zed.ReleaseSnapshot(r.ctx, v.Snapshot, tag); err != nil {
+					return err
+				}
+			}
+		}
+		found = found || v.Snapshot.Addr.Name == snapshot.Addr.Name
+	}
+
+	if err := r.zed.Rollback(r.ctx, *snapshot); err != nil {
+		return err
+	}
+
+	Logger.Info().Msgf("rolled back %s to %s", fs, snapshot.Address())
+	return nil
+}
+
+// chain verifies the archives of the file system are complete and returns the identity of the newest snapshot in each.
+func (r *remote) chain(fs zed.FileSystem) ([]string, error) {
+	paths, err := r.catalogue.verify(fs.String())
+	if err != nil {
+		return nil, err
+	}
+
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no archives for %s in %s", fs, r.entry.Bucket)
+	}
+
+	identities := make([]string, 0, len(paths))
+	for i := range paths {
+		entries, err := r.contents(fs, i)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(entries) == 0 {
+			return nil, fmt.Errorf("no contents retained in archive %d of %s", i, fs)
+		}
+		identities = append(identities, entries[len(entries)-1].Identity)
+	}
+	return identities, nil
+}
+
+// received determines how many archives are present in the target by comparing the GUIDs of its snapshots with the
+// contents of each archive. An archive is present if its newest snapshot exists in the target.
+func (r *remote) received(fs, target zed.FileSystem, paths [][]string) (int, error) {
+	listing, err := r.zed.ListSnapshots(r.ctx, target)
+	if errors.Is(err, zed.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if len(listing) == 0 {
+		return 0, nil
+	}
+
+	local := make(map[string]bool)
+	for _, v := range listing {
+		local[v.Identity] = true
+	}
+
+	for i := len(paths) - 1; i >= 0; i-- {
+		entries, err := r.contents(fs, i)
+		if err != nil {
+			return 0, err
+		}
+
+		if len(entries) > 0 && local[entries[len(entries)-1].Identity] {
+			Logger.Info().Msgf("archives 0 to %d of %s are present in %s", i, fs, target)
+			return i + 1, nil
+		}
+	}
+	return 0, nil
+}
+
+// planRestore records the archives which would be received along with the snapshots they contain. Archives before the
+// start are present in the target.
+func (r *remote) planRestore(fs, target zed.FileSystem, paths [][]string, start int) error {
+	if len(paths) == 0 {
+		return fmt.Errorf("no archives for %s in %s", fs, r.entry.Bucket)
+	}
+
+	for i := 0; i < start; i++ {
+		r.plan.add(fmt.Sprintf("skip archive %d of %s (present in %s)", i, fs, target))
+	}
 
-	for i, v := range paths {
-		err := r.restoreVolume(fs, i, v)
+	for i := start; i < len(paths); i++ {
+		volumes := paths[i]
+		entries, err := r.contents(fs, i)
 		if err != nil {
-			return fmt.Errorf("failed to restore %s (%w)", fs, err)
+			return err
+		}
+
+		details := make([]string, 0, len(entries)+len(volumes))
+		for _, v := range volumes {
+			details = append(details, fmt.Sprintf("download %s", v))
 		}
+		for _, v := range entries {
+			details = append(details, fmt.Sprintf("snapshot %s@%s", target, v.Name))
+		}
+		r.plan.add(fmt.Sprintf("receive archive %d of %s from %s into %s", i, fs, r.entry.Bucket, target), details...)
 	}
 	return nil
 }
 
-func (r *remote) restoreVolume(fs zed.FileSystem, index int, volumes []string) error {
+// restoreVolume receives an archive. The target is the file system being restored while into is the argument given to
+// 'zfs receive', which differs if part of the name is discarded.
+func (r *remote) restoreVolume(target zed.FileSystem, into string, index int, volumes []string, options zed.ReceiveOptions) error {
 	out, in := io.Pipe()
-	pool := fs.Pool
 
 	eg, ctx := errgroup.WithContext(r.ctx)
 	eg.Go(func() error {
-		err := r.zed.Receive(ctx, pool, out)
+		err := r.zed.Receive(ctx, into, out, options)
 		if err != nil {
-			Logger.Warn().Msgf("restore failed for %s: volume %d failed", pool, index)
+			Logger.Warn().Msgf("restore failed for %s: volume %d failed", target, index)
 			cause := fmt.Errorf("%w", err)
 			out.CloseWithError(err)
 			return cause
 		}
 
-		Logger.Info().Msgf("volume %d has been restored to %s", index, pool)
+		Logger.Info().Msgf("volume %d has been restored to %s", index, target)
 		return nil
 	})
 
-	Logger.Debug().Msgf("restoring volume %d to %s", index, pool)
+	Logger.Debug().Msgf("restoring volume %d to %s", index, target)
 
-	for _, volume := range volumes {
-		err := r.download(volume, in)
-		if err != nil {
-			in.CloseWithError(err)
-			return err
-		}
+	if err := r.download(volumes, in); err != nil {
+		// The receive must stop before the restore can be retried.
+		in.CloseWithError(err)
+		eg.Wait()
+		return err
 	}
 
 	in.Close()
 	return eg.Wait()
 }
 
-func (r *remote) download(path string, w io.Writer) error {
-	position := 0
-	offset := r.entry.PartSize*Megabyte - 1
+func (r *remote) refresh(fs zed.FileSystem) (*SendDetails, error) {
+	t, err := r.prepare(fs)
+	if err != nil {
+		return nil, err
+	}
+	return r.send(t)
+}
 
-	for i := 1; ; i++ {
-		object, err := r.stow.GetObject(r.ctx, r.entry.Bucket, path, position, position+offset)
-		if err != nil {
-			return fmt.Errorf("%w", err)
-		}
+// prepare determines the stream which brings the remote up to date with the file system.
+func (r *remote) prepare(fs zed.FileSystem) (*transfer, error) {
+	listing, err := r.zed.ListSnapshots(r.ctx, fs)
+	if err != nil {
+		return nil, err
+	}
 
-		n, err := w.Write(object.Content)
-		if err != nil {
-			return err
-		}
+	sequence, identity, err := r.last(fs)
+	if err != nil {
+		return nil, err
+	}
 
-		if object.End+1 == object.Size {
-			Logger.Info().Msgf("downloaded %s (%d MB)", path, object.Size/Megabyte)
-			return nil
-		}
+	var t *transfer
+	if sequence > 0 {
+		t, err = r.incremental(sequence, fs, listing, identity)
+	} else {
+		t, err = r.full(sequence, fs, listing)
+	}
 
-		Logger.Debug().Msgf("downloaded part %d (%d MB) of %s", i, n/Megabyte, path)
-		position = object.End + 1
+	if err != nil {
+		return nil, err
 	}
+	return r.resumeTarget(t), nil
 }
 
-func (r *remote) refresh(fs zed.FileSystem) error {
-	listing, err := r.zed.ListSnapshots(r.ctx, fs)
+// resumeTarget retargets the transfer at the snapshot of an interrupted upload so the upload can be continued rather
+// than started again. The transfer is unchanged if the snapshot no longer exists or the source differs.
+func (r *remote) resumeTarget(t *transfer) *transfer {
+	if r.resume == "" {
+		return t
+	}
+
+	existing, err := loadResumption(resumeFile(r.resume, r.entry, t.path()))
 	if err != nil {
-		return err
+		Logger.Warn().Msgf("ignoring interrupted upload of %s: %s", t.path(), err)
+		return t
+	}
+
+	if existing == nil || existing.state.Source != address(t.source) || existing.state.Identity == t.identity() {
+		return t
+	}
+
+	for _, v := range append(append([]zed.SnapshotListing{}, t.released...), t.included...) {
+		if v.Identity == existing.state.Identity {
+			Logger.Info().Msgf("resuming interrupted upload of %s to %s", v.Snapshot.Address(), r.entry.Bucket)
+			return t.retarget(v)
+		}
 	}
+	return t
+}
+
+// lastIdentity retrieves the identity of the newest archived snapshot or an empty string if nothing has been sent.
+func (r *remote) lastIdentity(fs zed.FileSystem) (string, error) {
+	_, identity, err := r.last(fs)
+	return identity, err
+}
 
+// last determines the number of archives and the identity of the newest archived snapshot. The replication state recorded
+// on the file system is used if it agrees with the catalogue. Otherwise the contents of the newest archive are retrieved
+// from the bucket. The state may lag the bucket (i.e. it couldn't be written after a send) but the archive it records
+// must still hold the same snapshot.
+func (r *remote) last(fs zed.FileSystem) (int, string, error) {
 	archives, err := r.catalogue.verify(fs.String())
 	if err != nil {
-		return err
+		return 0, "", err
 	}
 
-	sequence := len(archives)
-	if sequence > 0 {
-		previous := fmt.Sprintf("%s/%s/contents", fs.String(), padNumber(sequence-1))
-		contents, err := r.stow.GetObject(r.ctx, r.entry.Bucket, previous, 0, 0)
-		if err != nil {
-			return err
+	state, err := readState(r.ctx, r.zed, fs, r.entry)
+	if err != nil {
+		return 0, "", err
+	}
+
+	if state != nil {
+		if state.Archive == len(archives)-1 {
+			return len(archives), state.Identity, nil
+		}
+
+		if state.Archive < 0 || state.Archive >= len(archives) {
+			return 0, "", fmt.Errorf("%s has diverged from %s: archive %d was last sent but %d archives exist", fs, r.entry.Bucket, state.Archive, len(archives))
 		}
 
-		var entries []ArchiveEntry
-		err = json.Unmarshal(contents.Content, &entries)
+		identity, err := r.identity(fs, state.Archive)
 		if err != nil {
-			return err
+			return 0, "", err
 		}
 
-		if len(entries) == 0 {
-			return fmt.Errorf("no contents retained in %s", previous)
+		if identity != state.Identity {
+			return 0, "", fmt.Errorf("%s has diverged from %s: archive %d holds '%s' but '%s' was sent", fs, r.entry.Bucket, state.Archive, identity, state.Identity)
 		}
+		Logger.Warn().Msgf("state of %s records archive %d of %s but %d archives exist", fs, state.Archive, r.entry.Bucket, len(archives))
+	}
+
+	if len(archives) == 0 {
+		return 0, "", nil
+	}
 
-		path := fmt.Sprintf("%s/%s", fs.String(), padNumber(sequence))
-		return r.incremental(path, fs, listing, entries[len(entries)-1].Identity)
+	identity, err := r.identity(fs, len(archives)-1)
+	if err != nil {
+		return 0, "", err
+	}
+	return len(archives), identity, nil
+}
+
+func (r *remote) identity(fs zed.FileSystem, sequence int) (string, error) {
+	entries, err := r.contents(fs, sequence)
+	if err != nil {
+		return "", err
 	}
 
-	path := fmt.Sprintf("%s/%s", fs.String(), padNumber(sequence))
-	return r.full(path, fs, listing)
+	if len(entries) == 0 {
+		return "", fmt.Errorf("no contents retained in archive %d of %s", sequence, fs)
+	}
+	return entries[len(entries)-1].Identity, nil
+}
+
+// contents retrieves the snapshots contained within an archive.
+func (r *remote) contents(fs zed.FileSystem, sequence int) ([]ArchiveEntry, error) {
+	path := fmt.Sprintf("%s/%s/contents", fs.String(), padNumber(sequence))
+	contents, err := r.stow.GetObject(r.ctx, r.entry.Bucket, path, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []ArchiveEntry
+	if err := json.Unmarshal(contents.Content, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
 }
 
-func (r *remote) incremental(path string, fs zed.FileSystem, listing []zed.SnapshotListing, identity string) error {
+func (r *remote) incremental(archive int, fs zed.FileSystem, listing []zed.SnapshotListing, identity string) (*transfer, error) {
 	listing, err := r.zed.ListSnapshots(r.ctx, fs)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	for i, v := range listing {
 		if v.Identity == identity {
 			if i == len(listing)-1 {
-				return fmt.Errorf("remote is up to date")
+				return nil, errUpToDate
 			}
 			target := listing[len(listing)-1]
-			return r.send(path, &v.Snapshot, target.Snapshot, listing[i:])
+			return newTransfer(archive, v.Snapshot, target.Snapshot, listing[i:], listing[i:len(listing)-1]), nil
 		}
 	}
-	return fmt.Errorf("snapshot %s not found", identity)
+
+	// The archived snapshot may have been destroyed in which case its bookmark is used as the source.
+	bookmarks, err := r.zed.ListBookmarks(r.ctx, fs)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range bookmarks {
+		if v.Identity == identity {
+			// A replication stream can't originate from a bookmark so descendants would no longer be sent.
+			children, err := r.zed.ListFileSystems(r.ctx, fs)
+			if err != nil {
+				return nil, err
+			}
+
+			if len(children) > 1 {
+				return nil, fmt.Errorf("snapshot %s of %s has been destroyed and its bookmark can't be the source of a stream including descendants", identity, fs)
+			}
+
+			// The stream contains only its target so it ends at the first snapshot after the bookmark. Later snapshots
+			// keep their holds and are sent in the next stream.
+			for _, s := range listing {
+				if s.Transaction > v.Transaction {
+					return newTransfer(archive, v.Bookmark, s.Snapshot, []zed.SnapshotListing{s}, nil), nil
+				}
+			}
+			return nil, errUpToDate
+		}
+	}
+	return nil, fmt.Errorf("snapshot %s not found", identity)
 }
 
-func (r *remote) full(path string, fs zed.FileSystem, listing []zed.SnapshotListing) error {
+func (r *remote) full(archive int, fs zed.FileSystem, listing []zed.SnapshotListing) (*transfer, error) {
 	if len(listing) > 0 {
 		target := listing[len(listing)-1]
-		return r.send(path, nil, target.Snapshot, listing)
+		return newTransfer(archive, nil, target.Snapshot, listing, listing[:len(listing)-1]), nil
+	}
+	return nil, fmt.Errorf("no snapshots exist")
+}
+
+// transfer describes a stream from the source to the target stored as the numbered archive. The included snapshots are
+// recorded as the contents of the archive and holds are released from the released snapshots once successful.
+type transfer struct {
+	archive  int
+	source   zed.Addressable
+	target   zed.Snapshot
+	included []zed.SnapshotListing
+	released []zed.SnapshotListing
+}
+
+func newTransfer(archive int, source zed.Addressable, target zed.Snapshot, included, released []zed.SnapshotListing) *transfer {
+	return &transfer{
+		archive:  archive,
+		source:   source,
+		target:   target,
+		included: included,
+		released: released,
+	}
+}
+
+func (t *transfer) path() string {
+	return fmt.Sprintf("%s/%s", t.target.Addr.FileSystem.String(), padNumber(t.archive))
+}
+
+// identity is the GUID of the target snapshot.
+func (t *transfer) identity() string {
+	return t.included[len(t.included)-1].Identity
+}
+
+// retarget ends the transfer at an earlier snapshot.
+func (t *transfer) retarget(target zed.SnapshotListing) *transfer {
+	earlier := func(listing []zed.SnapshotListing, inclusive bool) []zed.SnapshotListing {
+		filtered := make([]zed.SnapshotListing, 0, len(listing))
+		for _, v := range listing {
+			if v.Transaction < target.Transaction || (inclusive && v.Transaction == target.Transaction) {
+				filtered = append(filtered, v)
+			}
+		}
+		return filtered
+	}
+
+	included := earlier(t.included, true)
+	switch t.source.(type) {
+	case zed.Bookmark, *zed.Bookmark:
+		included = []zed.SnapshotListing{target}
+	}
+	return newTransfer(t.archive, t.source, target.Snapshot, included, earlier(t.released, false))
+}
+
+// address is the address of a source or an empty string for a full stream.
+func address(source zed.Addressable) string {
+	if source == nil {
+		return ""
+	}
+	return source.Address()
+}
+
+// stream identifies the 'zfs send' which produces the transfer. Transfers with the same stream can share a send.
+func (t *transfer) stream() string {
+	if t.source == nil {
+		return t.target.Address()
 	}
-	return fmt.Errorf("no snapshots exist")
+	return t.source.Address() + " " + t.target.Address()
 }
 
-func (r *remote) send(path string, source *zed.Snapshot, target zed.Snapshot, included []zed.SnapshotListing) error {
+// send uploads the stream of the transfer.
+func (r *remote) send(t *transfer) (*SendDetails, error) {
+	if r.plan != nil {
+		r.planSend(t.path(), t.source, t.target, t.released)
+		return nil, nil
+	}
+
 	completion := func(err error) error {
 		if err == nil {
-			for _, snapshot := range included[:len(included)-1] {
-				for _, tag := range r.entry.Release {
-					r.zed.ReleaseSnapshot(r.ctx, snapshot.Snapshot, tag)
-				}
-			}
+			r.release(t.released)
 		}
 		return nil
 	}
 
-	stream, err := r.zed.Send(r.ctx, source, target, completion)
+	stream, err := r.zed.Send(r.ctx, t.source, t.target, completion)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	defer stream.Out.Close()
 
+	upload, err := r.newUpload(t, 1, true)
+	if err != nil {
+		return nil, err
+	}
+
+	details, err := r.store(t, upload, stream.Out)
+	if err != nil {
+		stream.Out.CloseWithError(err)
+		return nil, err
+	}
+
+	if err = stream.Wait(); err != nil {
+		return nil, err
+	}
+
+	r.finish(t, details)
+	return details, nil
+}
+
+// newUpload prepares an upload of the transfer. The threads are divided between the uploads sharing the stream. If wait
+// is false and the budget is exhausted an error is returned rather than waiting.
+func (r *remote) newUpload(t *transfer, shared int, wait bool) (*upload, error) {
+	threads := r.entry.Threads / shared
+	if threads < 1 {
+		threads = 1
+	}
+
 	upload, err := newUpload(
 		r.ctx,
 		r.stow,
 		r.entry.Bucket,
-		path,
-		r.entry.Threads,
+		t.path(),
+		threads,
 		r.entry.PartSize*Megabyte,
 		r.entry.VolumeSize*Megabyte,
+		r.budget,
+		wait,
 	)
+	if err != nil {
+		return nil, err
+	}
 
+	if r.resume != "" {
+		if upload.resume, err = r.resumption(t); err != nil {
+			upload.close()
+			return nil, err
+		}
+	}
+	return upload, nil
+}
+
+// resumption continues an interrupted upload of the transfer. An interrupted upload of a different stream to the same
+// path is aborted.
+func (r *remote) resumption(t *transfer) (*resumption, error) {
+	file := resumeFile(r.resume, r.entry, t.path())
+	state := uploadState{
+		Bucket:     r.entry.Bucket,
+		Path:       t.path(),
+		Source:     address(t.source),
+		Target:     t.target.Address(),
+		Identity:   t.identity(),
+		PartSize:   r.entry.PartSize * Megabyte,
+		VolumeSize: r.entry.VolumeSize * Megabyte,
+	}
+
+	existing, err := loadResumption(file)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	if existing != nil {
+		if existing.matches(state) {
+			return existing, nil
+		}
+
+		Logger.Info().Msgf("abandoning interrupted upload of %s to %s", existing.state.Target, r.entry.Bucket)
+		for _, v := range existing.state.Volumes {
+			if _, err := r.stow.AbortMultipartUpload(r.ctx, r.entry.Bucket, v.Key, v.Identifier); err != nil {
+				Logger.Warn().Msgf("failed to abort upload of %s: %s", v.Key, err)
+			}
+		}
+		existing.remove()
 	}
+	return newResumption(file, state), nil
+}
 
-	_, err = upload.Send(stream.Out, true)
+// store uploads the stream read from src followed by the contents of the archive.
+func (r *remote) store(t *transfer, upload *upload, src io.Reader) (*SendDetails, error) {
+	details, err := upload.Send(src, true)
 	if err != nil {
-		stream.Out.CloseWithError(err)
-		return err
+		return nil, err
 	}
 
-	if err := r.putContents(path+"/contents", included); err != nil {
-		return upload.Fail(true, err)
+	if err := r.putContents(t.path()+"/contents", t.included); err != nil {
+		return nil, upload.Fail(true, err)
 	}
+	return details, nil
+}
 
-	if err = stream.Wait(); err != nil {
+// release removes the holds of the send entry from the snapshots.
+func (r *remote) release(snapshots []zed.SnapshotListing) {
+	for _, snapshot := range snapshots {
+		for _, tag := range r.entry.Release {
+			r.zed.ReleaseSnapshot(r.ctx, snapshot.Snapshot, tag)
+		}
+	}
+}
+
+// finish bookmarks the target and records the replication state once the transfer has been stored.
+func (r *remote) finish(t *transfer, details *SendDetails) {
+	fs := t.target.Addr.FileSystem
+
+	if err := r.bookmark(t.target); err != nil {
+		Logger.Warn().Msgf("failed to bookmark '%s': %s", t.target.Address(), err)
+	}
+
+	state := ReplicationState{
+		Archive:  t.archive,
+		Snapshot: t.target.Addr.Name,
+		Identity: t.identity(),
+		Time:     time.Now().UTC(),
+		Bytes:    details.Bytes,
+	}
+
+	if err := writeState(r.ctx, r.zed, fs, r.entry, state); err != nil {
+		Logger.Warn().Msgf("failed to record state of '%s': %s", fs, err)
+	}
+}
+
+// planSend records the stream which would be sent along with the keys it would be stored under. The number of volumes
+// is derived from an estimate of the stream size.
+func (r *remote) planSend(path string, source zed.Addressable, target zed.Snapshot, released []zed.SnapshotListing) {
+	operation := fmt.Sprintf("send full %s to %s", target.Address(), r.entry.Bucket)
+	if source != nil {
+		operation = fmt.Sprintf("send incremental %s -> %s to %s", source.Address(), target.Address(), r.entry.Bucket)
+	}
+
+	details := make([]string, 0)
+	volumes := 1
+
+	size, err := r.zed.EstimateSend(r.ctx, source, target)
+	if err != nil {
+		Logger.Warn().Msgf("unable to estimate size of %s: %s", target.Address(), err)
+		details = append(details, "estimated size unknown")
+	} else {
+		details = append(details, fmt.Sprintf("estimated size %s", formatSize(size)))
+		volumeSize := int64(r.entry.VolumeSize) * Megabyte
+		volumes = int((size + volumeSize - 1) / volumeSize)
+		if volumes == 0 {
+			volumes = 1
+		}
+	}
+
+	for i := 0; i < volumes; i++ {
+		details = append(details, fmt.Sprintf("upload %s/%s", path, padNumber(i)))
+	}
+	details = append(details, fmt.Sprintf("upload %s/contents", path))
+
+	for _, snapshot := range released {
+		for _, tag := range r.entry.Release {
+			details = append(details, fmt.Sprintf("release '%s' on %s", tag, snapshot.Snapshot.Address()))
+		}
+	}
+	details = append(details, fmt.Sprintf("bookmark %s", zed.Bookmark{Addr: target.Addr}.Address()))
+
+	r.plan.add(operation, details...)
+}
+
+// bookmark preserves the target such that it remains usable as an incremental source once the snapshot is destroyed.
+func (r *remote) bookmark(target zed.Snapshot) error {
+	bookmarks, err := r.zed.ListBookmarks(r.ctx, target.Addr.FileSystem)
+	if err != nil {
 		return err
 	}
-	return nil
+
+	for _, v := range bookmarks {
+		if v.Bookmark.Addr == target.Addr {
+			return nil
+		}
+	}
+
+	_, err = r.zed.CreateBookmark(r.ctx, zed.Bookmark{Addr: target.Addr}, target)
+	return err
 }
 
 func (r *remote) putContents(path string, listing []zed.SnapshotListing) error {
@@ -305,6 +847,43 @@ func (c catalogue) verify(fs string) ([][]string, error) {
 	return verified, nil
 }
 
+// length is the number of archives in the chain including any which are missing.
+func (c catalogue) length(fs string) int {
+	length := 0
+	for archive := range c[fs] {
+		if archive+1 > length {
+			length = archive + 1
+		}
+	}
+	return length
+}
+
+// missing lists the archives and volumes absent from the chain. A missing final volume cannot be detected.
+func (c catalogue) missing(fs string) []string {
+	missing := make([]string, 0)
+	for i := 0; i < c.length(fs); i++ {
+		volumes, ok := c[fs][i]
+		if !ok {
+			missing = append(missing, fmt.Sprintf("archive %d", i))
+			continue
+		}
+
+		count := 0
+		for volume := range volumes {
+			if volume+1 > count {
+				count = volume + 1
+			}
+		}
+
+		for j := 0; j < count; j++ {
+			if _, ok := volumes[j]; !ok {
+				missing = append(missing, fmt.Sprintf("volume %d of archive %d", j, i))
+			}
+		}
+	}
+	return missing
+}
+
 // ArchiveEntry represents an item stored in the archive
 type ArchiveEntry struct {
 	Name     string    `json:"name"`
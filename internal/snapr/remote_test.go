@@ -1,9 +1,18 @@
 package snapr
 
 import (
+	"context"
+	"net/http"
+	"snapr/internal/stow"
+	"snapr/internal/stow/stowtest"
+	"snapr/internal/zed"
+	"snapr/internal/zed/zedtest"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestCatalogue(t *testing.T) {
@@ -67,3 +76,195 @@ func TestCatalogueWithMissingVolume(t *testing.T) {
 
 	assert.Error(t, err)
 }
+
+func TestCatalogueMissing(t *testing.T) {
+	fs := "pool-0/test"
+	listing := []string{
+		fs + "/00000/00000",
+		fs + "/00000/00002",
+		fs + "/00002/00000",
+	}
+
+	catalogue := make(catalogue)
+	catalogue.load(listing)
+
+	assert.Equal(t, 3, catalogue.length(fs))
+	assert.Equal(t, []string{"volume 1 of archive 0", "archive 1"}, catalogue.missing(fs))
+	assert.Equal(t, 0, catalogue.length("pool-0/other"))
+	assert.Empty(t, catalogue.missing("pool-0/other"))
+}
+
+func TestRestoreResume(t *testing.T) {
+	fs := zed.FileSystem{Pool: "pool-0", Name: "test"}
+	ctx := context.Background()
+
+	local := zedtest.New()
+	testClock(local)
+	require.NoError(t, local.CreateFileSystem(fs))
+
+	provider := stowtest.New(testEndpoint)
+	s := testSnapr(t, local, provider, testSettings(fs.String()))
+
+	require.NoError(t, local.Write(fs, testData(1, Megabyte)))
+	s.Snap()
+	s.Send()
+
+	// The second archive spans several volumes.
+	require.NoError(t, local.Write(fs, testData(2, 3*Megabyte)))
+	s.Snap()
+	s.Send()
+	require.Contains(t, provider.Keys("bucket"), "pool-0/test/00001/00001")
+
+	var mu sync.Mutex
+	var fetched []string
+	failing := true
+	provider.Fail = func(req *http.Request) error {
+		if req.Method != http.MethodGet || req.URL.Query().Get("list-type") != "" {
+			return nil
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		key := strings.TrimPrefix(req.URL.Path, "/")
+		fetched = append(fetched, key)
+		if failing && key == "pool-0/test/00001/00001" {
+			return &stow.StatusError{StatusCode: http.StatusForbidden}
+		}
+		return nil
+	}
+
+	// The first archive is received and the second is discarded by the receive.
+	remote := zedtest.New()
+	r := testSnapr(t, remote, provider, testSettings(fs.String()))
+	require.Error(t, r.Restore(fs.String()))
+
+	listing, err := remote.ListSnapshots(ctx, fs)
+	require.NoError(t, err)
+	assert.Len(t, listing, 1)
+
+	// A retry receives only the second archive.
+	mu.Lock()
+	failing = false
+	fetched = nil
+	mu.Unlock()
+
+	require.NoError(t, r.Restore(fs.String()))
+	for _, v := range fetched {
+		assert.False(t, strings.HasPrefix(v, "pool-0/test/00000/0"), "volume %s fetched again", v)
+	}
+
+	restored, err := remote.Read(fs)
+	require.NoError(t, err)
+	assert.Equal(t, testData(2, 3*Megabyte), restored)
+
+	listing, err = remote.ListSnapshots(ctx, fs)
+	require.NoError(t, err)
+	assert.Len(t, listing, 2)
+}
+
+func TestRestorePoint(t *testing.T) {
+	fs := zed.FileSystem{Pool: "pool-0", Name: "test"}
+	ctx := context.Background()
+
+	local := zedtest.New()
+	testClock(local)
+	require.NoError(t, local.CreateFileSystem(fs))
+
+	provider := stowtest.New(testEndpoint)
+	s := testSnapr(t, local, provider, testSettings(fs.String()))
+
+	// The second archive holds two snapshots.
+	require.NoError(t, local.Write(fs, testData(1, 100)))
+	s.Snap()
+	s.Send()
+	require.NoError(t, local.Write(fs, testData(2, 100)))
+	s.Snap()
+	require.NoError(t, local.Write(fs, testData(3, 100)))
+	s.Snap()
+	s.Send()
+	require.NoError(t, local.Write(fs, testData(4, 100)))
+	s.Snap()
+	s.Send()
+	require.Contains(t, provider.Keys("bucket"), "pool-0/test/00002/contents")
+
+	names := func(fake *zedtest.Fake) []string {
+		listing, err := fake.ListSnapshots(ctx, fs)
+		require.NoError(t, err)
+		names := make([]string, 0)
+		for _, v := range listing {
+			names = append(names, v.Snapshot.Addr.Name)
+		}
+		return names
+	}
+
+	// An archive is restored along with those before it.
+	remote := zedtest.New()
+	r := testSnapr(t, remote, provider, testSettings(fs.String()))
+	require.NoError(t, r.RestoreWith(fs.String(), RestoreOptions{Archive: 1}))
+	assert.Equal(t, []string{"daily-00000", "daily-00001", "daily-00002"}, names(remote))
+
+	// A restore point before the local file system is refused.
+	assert.Error(t, r.RestoreWith(fs.String(), RestoreOptions{Archive: 0}))
+
+	// A snapshot in the middle of an archive is received with the later snapshots of the archive.
+	remote = zedtest.New()
+	r = testSnapr(t, remote, provider, testSettings(fs.String()))
+	require.NoError(t, r.RestoreWith(fs.String(), RestoreOptions{Snapshot: "daily-00001"}))
+	assert.Equal(t, []string{"daily-00000", "daily-00001", "daily-00002"}, names(remote))
+
+	// The file system can then be rolled back to the snapshot.
+	require.NoError(t, r.RestoreWith(fs.String(), RestoreOptions{Snapshot: "daily-00001", Rollback: true}))
+	assert.Equal(t, []string{"daily-00000", "daily-00001"}, names(remote))
+	restored, err := remote.Read(fs)
+	require.NoError(t, err)
+	assert.Equal(t, testData(2, 100), restored)
+
+	// The newest snapshot of an archive needs no rollback.
+	remote = zedtest.New()
+	r = testSnapr(t, remote, provider, testSettings(fs.String()))
+	require.NoError(t, r.RestoreWith(fs.String(), RestoreOptions{Snapshot: "daily-00000", Rollback: true}))
+	assert.Equal(t, []string{"daily-00000"}, names(remote))
+
+	assert.Error(t, r.RestoreWith(fs.String(), RestoreOptions{Snapshot: "daily-00009"}))
+	assert.Error(t, r.RestoreWith(fs.String(), RestoreOptions{Archive: 3}))
+}
+
+func TestRestoreTarget(t *testing.T) {
+	fs := zed.FileSystem{Pool: "pool-0", Name: "test"}
+	ctx := context.Background()
+
+	local := zedtest.New()
+	testClock(local)
+	require.NoError(t, local.CreateFileSystem(fs))
+
+	provider := stowtest.New(testEndpoint)
+	s := testSnapr(t, local, provider, testSettings(fs.String()))
+
+	require.NoError(t, local.Write(fs, testData(1, 100)))
+	s.Snap()
+	s.Send()
+	require.NoError(t, local.Write(fs, testData(2, 100)))
+	s.Snap()
+	s.Send()
+
+	// The file system is restored alongside the original under a new name.
+	renamed := zed.FileSystem{Pool: "pool-0", Name: "test-restored"}
+	require.NoError(t, s.RestoreWith(fs.String(), RestoreOptions{Target: renamed.String(), Archive: -1}))
+	restored, err := local.Read(renamed)
+	require.NoError(t, err)
+	assert.Equal(t, testData(2, 100), restored)
+
+	listing, err := local.ListSnapshots(ctx, renamed)
+	require.NoError(t, err)
+	assert.Len(t, listing, 2)
+
+	// A pool keeps the name of the file system.
+	pooled := zed.FileSystem{Pool: "backup-pool", Name: "test"}
+	require.NoError(t, s.RestoreWith(fs.String(), RestoreOptions{Target: pooled.Pool, Archive: -1}))
+	assert.True(t, local.Exists(pooled))
+
+	// The original is left untouched.
+	original, err := local.Read(fs)
+	require.NoError(t, err)
+	assert.Equal(t, testData(2, 100), original)
+}
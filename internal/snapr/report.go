@@ -0,0 +1,79 @@
+package snapr
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Result records the result of an operation on a file system. The destination is only set for sends.
+type Result struct {
+	FileSystem  string
+	Destination string
+	Detail      string
+	Err         error
+}
+
+// destination identifies where a send entry stores archives.
+func (e SendEntry) destination() string {
+	return e.Endpoint + "/" + e.Bucket
+}
+
+// MarshalJSON writes the error as a string.
+func (r Result) MarshalJSON() ([]byte, error) {
+	raw := struct {
+		FileSystem  string `json:"fileSystem"`
+		Destination string `json:"destination,omitempty"`
+		Detail      string `json:"detail,omitempty"`
+		Error       string `json:"error,omitempty"`
+	}{
+		FileSystem:  r.FileSystem,
+		Destination: r.Destination,
+		Detail:      r.Detail,
+	}
+
+	if r.Err != nil {
+		raw.Error = r.Err.Error()
+	}
+	return json.Marshal(raw)
+}
+
+// Report holds the results of a run.
+type Report struct {
+	Operation string   `json:"operation"`
+	Results   []Result `json:"results"`
+}
+
+// Failures returns the results which failed.
+func (r Report) Failures() []Result {
+	failures := make([]Result, 0)
+	for _, v := range r.Results {
+		if v.Err != nil {
+			failures = append(failures, v)
+		}
+	}
+	return failures
+}
+
+// Failed indicates whether every result failed. A report without results has not failed.
+func (r Report) Failed() bool {
+	return len(r.Results) > 0 && len(r.Failures()) == len(r.Results)
+}
+
+// Err summarises the failures. Nil is returned if nothing failed.
+func (r Report) Err() error {
+	failures := r.Failures()
+	if len(failures) == 0 {
+		return nil
+	}
+
+	messages := make([]string, 0, len(failures))
+	for _, v := range failures {
+		target := v.FileSystem
+		if v.Destination != "" {
+			target += " to " + v.Destination
+		}
+		messages = append(messages, fmt.Sprintf("%s: %s", target, v.Err))
+	}
+	return fmt.Errorf("%s failed for %d of %d (%s)", r.Operation, len(failures), len(r.Results), strings.Join(messages, "; "))
+}
@@ -0,0 +1,64 @@
+package snapr
+
+import (
+	"encoding/json"
+	"net/http"
+	"snapr/internal/stow"
+	"snapr/internal/stow/stowtest"
+	"snapr/internal/zed"
+	"snapr/internal/zed/zedtest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReport(t *testing.T) {
+	report := Report{Operation: "send"}
+	assert.NoError(t, report.Err())
+	assert.False(t, report.Failed())
+
+	report.Results = []Result{
+		{FileSystem: "pool-0/first", Destination: "s3.example.com/bucket", Detail: "up to date"},
+		{FileSystem: "pool-0/second", Destination: "s3.example.com/bucket", Err: assert.AnError},
+	}
+	assert.Len(t, report.Failures(), 1)
+	assert.False(t, report.Failed())
+	assert.EqualError(t, report.Err(), "send failed for 1 of 2 (pool-0/second to s3.example.com/bucket: "+assert.AnError.Error()+")")
+
+	report.Results[0].Err = assert.AnError
+	assert.True(t, report.Failed())
+
+	raw, err := json.Marshal(report.Results[1])
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"fileSystem":"pool-0/second","destination":"s3.example.com/bucket","error":"`+assert.AnError.Error()+`"}`, string(raw))
+}
+
+func TestSendReport(t *testing.T) {
+	fs := zed.FileSystem{Pool: "pool-0", Name: "test"}
+
+	local := zedtest.New()
+	testClock(local)
+	require.NoError(t, local.CreateFileSystem(fs))
+	require.NoError(t, local.Write(fs, testData(1, 100)))
+
+	provider := stowtest.New(testEndpoint)
+	s := testSnapr(t, local, provider, testSettings(fs.String()))
+
+	report := s.Snap()
+	require.NoError(t, report.Err())
+	require.Len(t, report.Results, 1)
+	assert.Equal(t, "created pool-0/test@daily-00000", report.Results[0].Detail)
+
+	report = s.Send()
+	require.NoError(t, report.Err())
+	require.Len(t, report.Results, 1)
+	assert.Equal(t, testEndpoint+"/bucket", report.Results[0].Destination)
+
+	provider.Fail = func(*http.Request) error {
+		return &stow.StatusError{StatusCode: http.StatusForbidden}
+	}
+	report = s.Send()
+	assert.Error(t, report.Err())
+	assert.True(t, report.Failed())
+}
@@ -2,14 +2,21 @@ package snapr
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"snapr/internal/stow"
 	"snapr/internal/zed"
+	"strconv"
+	"strings"
 )
 
 type restorer struct {
 	ctx      context.Context
-	zed      *zed.Zed
+	zed      zed.ZFS
 	settings *Settings
+	stow     []stow.SetOption
+	plan     *plan
+	budget   *budget
 }
 
 func (s *Snapr) newRestorer() *restorer {
@@ -17,35 +24,268 @@ func (s *Snapr) newRestorer() *restorer {
 		ctx:      s.ctx,
 		zed:      s.zed,
 		settings: s.settings,
+		stow:     s.stow,
+		plan:     s.plan,
+		budget:   s.budget,
 	}
 }
 
-func (r *restorer) restore(target string) error {
-	entries, ok := r.settings.FileSystems[target]
+// RestoreOptions determine where a file system is restored to and how many of its archives are received.
+type RestoreOptions struct {
+	// Target is the file system or pool to receive into. The file system keeps its name if a pool is given. By default
+	// the file system is restored to its original name.
+	Target string
+
+	// Snapshot is the name of the snapshot to restore. It takes precedence over Archive.
+	Snapshot string
+
+	// Archive is the last archive to receive. A negative value receives every archive.
+	Archive int
+
+	// Rollback reverts the file system to Snapshot if later snapshots in its archive were received with it.
+	Rollback bool
+
+	// Destination selects the send entry to restore from by name or index. By default the last entry is used.
+	Destination string
+
+	// Fallback tries the other send entries if the selected entry doesn't hold a complete chain or fails part way.
+	Fallback bool
+
+	// Receive options are applied over those configured for the file system.
+	Receive ReceiveOverrides
+}
+
+// ReceiveOverrides are receive options given for a restore. A property which is set removes a configured exclusion of
+// the same name and an excluded property removes a configured value. A nil boolean keeps the configured value.
+type ReceiveOverrides struct {
+	Properties map[string]string
+	Exclude    []string
+	NoMount    *bool
+	Force      *bool
+	Discard    string
+}
+
+func (r *restorer) restore(fileSystem string, options RestoreOptions) error {
+	entries, ok := r.settings.FileSystems[fileSystem]
 	if !ok {
-		Logger.Warn().Msgf("restore failed for %s: not configured", target)
+		Logger.Warn().Msgf("restore failed for %s: not configured", fileSystem)
 	}
 
 	if len(entries.Send) == 0 {
-		return fmt.Errorf("restore failed for %s: at least one send entry required", target)
+		return fmt.Errorf("restore failed for %s: at least one send entry required", fileSystem)
+	}
+
+	fs, err := zed.ToFileSystem(fileSystem)
+	if err != nil {
+		return fmt.Errorf("restore failed for %s: %w", fileSystem, err)
 	}
 
-	entry := entries.Send[len(entries.Send)-1].Inherit(r.settings)
+	receive := mergeReceive(entries.Receive, options.Receive)
+	if err := receive.Validate(); err != nil {
+		return fmt.Errorf("restore failed for %s: %w", fileSystem, err)
+	}
 
-	fs, err := zed.ToFileSystem(target)
+	target, err := restoreTarget(*fs, options.Target, receive.Discard)
 	if err != nil {
-		return fmt.Errorf("restore failed for %s: %w", target, err)
+		return fmt.Errorf("restore failed for %s: %w", fileSystem, err)
 	}
 
-	remote, err := newRemote(r.ctx, r.zed, entry)
+	sources, err := restoreSources(entries.Send, options.Destination)
 	if err != nil {
-		return fmt.Errorf("restore failed for %s: %w", target, err)
+		return fmt.Errorf("restore failed for %s: %w", fileSystem, err)
 	}
 
-	if err := remote.restore(*fs); err != nil {
-		return fmt.Errorf("restore failed for %s: %w", target, err)
+	if !options.Fallback {
+		entry := sources[0].Inherit(r.settings)
+		remote, err := newRemote(r.ctx, r.zed, entry, r.plan, r.stow...)
+		if err != nil {
+			return fmt.Errorf("restore failed for %s: %w", fileSystem, err)
+		}
+		remote.budget = r.budget
+
+		if err := remote.restore(*fs, *target, options, receive); err != nil {
+			return fmt.Errorf("restore failed for %s: %w", fileSystem, err)
+		}
+	} else if err := r.fallback(*fs, *target, sources, options, receive); err != nil {
+		return fmt.Errorf("restore failed for %s: %w", fileSystem, err)
 	}
 
-	Logger.Info().Msgf("restored %s", target)
+	if r.plan == nil {
+		Logger.Info().Msgf("restored %s to %s", fileSystem, target)
+	}
 	return nil
 }
+
+// fallback restores from the first destination holding a complete chain of archives. If the restore fails part way it
+// continues from the next destination holding the same archives. Archives already received are skipped.
+func (r *restorer) fallback(fs, target zed.FileSystem, sources []SendEntry, options RestoreOptions, receive zed.ReceiveOptions) error {
+	var chain []string
+	var failed string
+	var cause error
+
+	for _, v := range sources {
+		entry := v.Inherit(r.settings)
+
+		remote, err := newRemote(r.ctx, r.zed, entry, r.plan, r.stow...)
+		if err != nil {
+			Logger.Warn().Msgf("skipping %s for %s: %s", entry.destination(), fs, err)
+			cause = err
+			continue
+		}
+		remote.budget = r.budget
+
+		identities, err := remote.chain(fs)
+		if err != nil {
+			Logger.Warn().Msgf("skipping %s for %s: %s", entry.destination(), fs, err)
+			cause = err
+			continue
+		}
+
+		if chain != nil && !sameChain(chain, identities) {
+			Logger.Warn().Msgf("skipping %s for %s: archives differ from %s", entry.destination(), fs, failed)
+			continue
+		}
+
+		if err := remote.restore(fs, target, options, receive); err != nil {
+			Logger.Warn().Msgf("restore of %s from %s failed: %s", fs, entry.destination(), err)
+			chain = identities
+			failed = entry.destination()
+			cause = err
+			continue
+		}
+		return nil
+	}
+
+	if cause == nil {
+		cause = errors.New("destinations hold different archives")
+	}
+	return fmt.Errorf("no destination could be restored from (%w)", cause)
+}
+
+// restoreSources orders the send entries so the selected entry is first followed by the others in configured order. An
+// entry is selected by name or index and the last entry is selected by default.
+func restoreSources(entries []SendEntry, destination string) ([]SendEntry, error) {
+	selected := -1
+	if destination == "" {
+		selected = len(entries) - 1
+	}
+
+	for i, v := range entries {
+		if selected < 0 && v.Name != "" && v.Name == destination {
+			selected = i
+		}
+	}
+
+	if selected < 0 {
+		i, err := strconv.Atoi(destination)
+		if err != nil || i < 0 || i >= len(entries) {
+			return nil, fmt.Errorf("no destination named '%s'", destination)
+		}
+		selected = i
+	}
+
+	sources := []SendEntry{entries[selected]}
+	for i, v := range entries {
+		if i != selected {
+			sources = append(sources, v)
+		}
+	}
+	return sources, nil
+}
+
+// sameChain determines whether a destination holds the archives of another. It may hold newer archives.
+func sameChain(chain, other []string) bool {
+	if len(other) < len(chain) {
+		return false
+	}
+
+	for i, v := range chain {
+		if other[i] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// restoreTarget determines the file system to receive into. A target without a name is a pool. If part of the name is
+// discarded the target is the parent of the file system, which defaults to the pool of the original.
+func restoreTarget(fs zed.FileSystem, target, discard string) (*zed.FileSystem, error) {
+	if discard != "" {
+		parent := target
+		if parent == "" {
+			parent = fs.Pool
+		}
+
+		name := fs.Name
+		if discard == zed.DiscardParents {
+			elements := strings.Split(fs.Name, "/")
+			name = elements[len(elements)-1]
+		}
+		return zed.ToFileSystem(parent + "/" + name)
+	}
+
+	if target == "" {
+		return &fs, nil
+	}
+
+	if !strings.Contains(target, "/") {
+		return &zed.FileSystem{Pool: target, Name: fs.Name}, nil
+	}
+	return zed.ToFileSystem(target)
+}
+
+// receiveInto is the argument to 'zfs receive' which results in the target file system.
+func receiveInto(fs, target zed.FileSystem, discard string) string {
+	switch discard {
+	case zed.DiscardFirst:
+		return strings.TrimSuffix(target.String(), "/"+fs.Name)
+	case zed.DiscardParents:
+		elements := strings.Split(fs.Name, "/")
+		return strings.TrimSuffix(target.String(), "/"+elements[len(elements)-1])
+	}
+	return target.String()
+}
+
+// mergeReceive applies the receive options given for a restore over those configured for the file system. A given
+// property replaces a configured exclusion of the same name and vice versa.
+func mergeReceive(configured zed.ReceiveOptions, given ReceiveOverrides) zed.ReceiveOptions {
+	merged := zed.ReceiveOptions{
+		Properties: make(map[string]string),
+		Exclude:    make([]string, 0, len(configured.Exclude)+len(given.Exclude)),
+		NoMount:    configured.NoMount,
+		Force:      configured.Force,
+		Discard:    configured.Discard,
+	}
+
+	excluded := make(map[string]bool)
+	for _, name := range given.Exclude {
+		excluded[name] = true
+	}
+
+	for name, value := range configured.Properties {
+		if !excluded[name] {
+			merged.Properties[name] = value
+		}
+	}
+	for name, value := range given.Properties {
+		merged.Properties[name] = value
+	}
+
+	for _, name := range configured.Exclude {
+		if _, ok := given.Properties[name]; !ok {
+			merged.Exclude = append(merged.Exclude, name)
+		}
+	}
+	merged.Exclude = append(merged.Exclude, given.Exclude...)
+
+	if given.NoMount != nil {
+		merged.NoMount = *given.NoMount
+	}
+	if given.Force != nil {
+		merged.Force = *given.Force
+	}
+	if given.Discard != "" {
+		merged.Discard = given.Discard
+	}
+	return merged
+}
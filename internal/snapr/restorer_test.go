@@ -0,0 +1,234 @@
+package snapr
+
+import (
+	"context"
+	"net/http"
+	"snapr/internal/stow"
+	"snapr/internal/stow/stowtest"
+	"snapr/internal/zed"
+	"snapr/internal/zed/zedtest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testDestinations configures a primary and secondary destination for the file system.
+func testDestinations(fs string) *Settings {
+	settings := testSettings(fs)
+	primary := settings.FileSystems[fs].Send[0]
+	primary.Name = "primary"
+	primary.Bucket = "primary"
+	secondary := primary
+	secondary.Name = "secondary"
+	secondary.Bucket = "secondary"
+
+	entries := settings.FileSystems[fs]
+	entries.Send = []SendEntry{primary, secondary}
+	settings.FileSystems[fs] = entries
+	return settings
+}
+
+func TestRestoreSources(t *testing.T) {
+	entries := testDestinations("pool-0/test").FileSystems["pool-0/test"].Send
+	names := func(sources []SendEntry) []string {
+		names := make([]string, 0)
+		for _, v := range sources {
+			names = append(names, v.Name)
+		}
+		return names
+	}
+
+	sources, err := restoreSources(entries, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"secondary", "primary"}, names(sources))
+
+	sources, err = restoreSources(entries, "primary")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"primary", "secondary"}, names(sources))
+
+	sources, err = restoreSources(entries, "1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"secondary", "primary"}, names(sources))
+
+	_, err = restoreSources(entries, "tertiary")
+	assert.Error(t, err)
+	_, err = restoreSources(entries, "2")
+	assert.Error(t, err)
+}
+
+func TestRestoreFallback(t *testing.T) {
+	fs := zed.FileSystem{Pool: "pool-0", Name: "test"}
+	ctx := context.Background()
+
+	local := zedtest.New()
+	testClock(local)
+	require.NoError(t, local.CreateFileSystem(fs))
+
+	provider := stowtest.New(testEndpoint)
+	s := testSnapr(t, local, provider, testDestinations(fs.String()))
+
+	require.NoError(t, local.Write(fs, testData(1, 100)))
+	s.Snap()
+	s.Send()
+	require.NoError(t, local.Write(fs, testData(2, 3*Megabyte)))
+	s.Snap()
+	s.Send()
+	require.Contains(t, provider.Keys("secondary"), "pool-0/test/00001/00001")
+	require.Contains(t, provider.Keys("primary"), "pool-0/test/00001/00001")
+
+	var mu sync.Mutex
+	var fetched []string
+	provider.Fail = func(req *http.Request) error {
+		if req.Method != http.MethodGet || req.URL.Query().Get("list-type") != "" {
+			return nil
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		bucket := strings.TrimSuffix(req.URL.Hostname(), "."+testEndpoint)
+		key := bucket + ":" + strings.TrimPrefix(req.URL.Path, "/")
+		fetched = append(fetched, key)
+		if key == "secondary:pool-0/test/00001/00001" {
+			return &stow.StatusError{StatusCode: http.StatusForbidden}
+		}
+		return nil
+	}
+
+	// Without a fallback the restore fails part way.
+	remote := zedtest.New()
+	r := testSnapr(t, remote, provider, testDestinations(fs.String()))
+	require.Error(t, r.Restore(fs.String()))
+
+	// The restore continues from the primary without downloading the first archive again.
+	mu.Lock()
+	fetched = nil
+	mu.Unlock()
+
+	require.NoError(t, r.RestoreWith(fs.String(), RestoreOptions{Archive: -1, Fallback: true}))
+	restored, err := remote.Read(fs)
+	require.NoError(t, err)
+	assert.Equal(t, testData(2, 3*Megabyte), restored)
+
+	mu.Lock()
+	assert.Contains(t, fetched, "primary:pool-0/test/00001/00000")
+	assert.NotContains(t, fetched, "primary:pool-0/test/00000/00000")
+	mu.Unlock()
+
+	// A destination with a missing volume is skipped.
+	provider.Fail = nil
+	provider.Delete("primary", "pool-0/test/00001/00000")
+	remote = zedtest.New()
+	r = testSnapr(t, remote, provider, testDestinations(fs.String()))
+	assert.Error(t, r.RestoreWith(fs.String(), RestoreOptions{Archive: -1, Destination: "primary"}))
+	require.NoError(t, r.RestoreWith(fs.String(), RestoreOptions{Archive: -1, Destination: "primary", Fallback: true}))
+
+	listing, err := remote.ListSnapshots(ctx, fs)
+	require.NoError(t, err)
+	assert.Len(t, listing, 2)
+}
+
+func TestRestoreReceiveOptions(t *testing.T) {
+	fs := zed.FileSystem{Pool: "pool-0", Name: "test"}
+
+	local := zedtest.New()
+	testClock(local)
+	require.NoError(t, local.CreateFileSystem(fs))
+
+	settings := testSettings(fs.String())
+	entries := settings.FileSystems[fs.String()]
+	entries.Receive = zed.ReceiveOptions{
+		Properties: map[string]string{"mountpoint": "/srv/test", "canmount": "noauto"},
+		NoMount:    true,
+	}
+	settings.FileSystems[fs.String()] = entries
+
+	provider := stowtest.New(testEndpoint)
+	s := testSnapr(t, local, provider, settings)
+
+	require.NoError(t, local.Write(fs, testData(1, 100)))
+	s.Snap()
+	s.Send()
+
+	// Options given for the restore are applied over those configured.
+	options := RestoreOptions{
+		Target:  "backup",
+		Archive: -1,
+		Receive: ReceiveOverrides{
+			Properties: map[string]string{"mountpoint": "/mnt/test"},
+			Discard:    zed.DiscardFirst,
+		},
+	}
+	require.NoError(t, s.RestoreWith(fs.String(), options))
+
+	restored := zed.FileSystem{Pool: "backup", Name: "test"}
+	assert.True(t, local.Exists(restored))
+	assert.False(t, local.Mounted(restored))
+
+	mountpoint, _ := local.Property(restored, "mountpoint")
+	assert.Equal(t, "/mnt/test", mountpoint)
+	canmount, _ := local.Property(restored, "canmount")
+	assert.Equal(t, "noauto", canmount)
+
+	// Invalid options are refused before anything is received.
+	options = RestoreOptions{Target: "invalid", Archive: -1, Receive: ReceiveOverrides{
+		Properties: map[string]string{"compression": "lz4"},
+		Exclude:    []string{"compression"},
+	}}
+	assert.Error(t, s.RestoreWith(fs.String(), options))
+	assert.False(t, local.Exists(zed.FileSystem{Pool: "invalid", Name: "test"}))
+}
+
+func TestRestoreTargetNames(t *testing.T) {
+	fs := zed.FileSystem{Pool: "pool-0", Name: "data/test"}
+
+	for _, v := range []struct {
+		target, discard, expected, into string
+	}{
+		{"", "", "pool-0/data/test", "pool-0/data/test"},
+		{"backup", "", "backup/data/test", "backup/data/test"},
+		{"backup/restored", "", "backup/restored", "backup/restored"},
+		{"", zed.DiscardFirst, "pool-0/data/test", "pool-0"},
+		{"backup/restores", zed.DiscardFirst, "backup/restores/data/test", "backup/restores"},
+		{"backup", zed.DiscardParents, "backup/test", "backup"},
+	} {
+		target, err := restoreTarget(fs, v.target, v.discard)
+		require.NoError(t, err)
+		assert.Equal(t, v.expected, target.String())
+		assert.Equal(t, v.into, receiveInto(fs, *target, v.discard))
+	}
+}
+
+func TestMergeReceive(t *testing.T) {
+	configured := zed.ReceiveOptions{
+		Properties: map[string]string{"mountpoint": "/srv/test", "canmount": "noauto"},
+		Exclude:    []string{"sharenfs"},
+		NoMount:    true,
+		Force:      true,
+	}
+
+	// Without overrides the configured options are used.
+	assert.Equal(t, configured, mergeReceive(configured, ReceiveOverrides{}))
+
+	// A given property replaces a configured exclusion and a given exclusion replaces a configured property.
+	disabled := false
+	merged := mergeReceive(configured, ReceiveOverrides{
+		Properties: map[string]string{"sharenfs": "on"},
+		Exclude:    []string{"mountpoint"},
+		NoMount:    &disabled,
+		Force:      &disabled,
+	})
+	assert.Equal(t, zed.ReceiveOptions{
+		Properties: map[string]string{"canmount": "noauto", "sharenfs": "on"},
+		Exclude:    []string{"mountpoint"},
+	}, merged)
+	assert.NoError(t, merged.Validate())
+
+	// Booleans given as true are applied over unset configuration.
+	enabled := true
+	merged = mergeReceive(zed.ReceiveOptions{}, ReceiveOverrides{NoMount: &enabled, Force: &enabled})
+	assert.True(t, merged.NoMount)
+	assert.True(t, merged.Force)
+}
@@ -0,0 +1,197 @@
+package snapr
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// errDiverged indicates a stream differs from the one whose upload was interrupted.
+var errDiverged = errors.New("stream differs from the interrupted upload")
+
+var invalidFileName = regexp.MustCompile(`[^a-zA-Z0-9._-]`)
+
+// resumption persists the progress of an upload so it can be continued after an interruption. A 'zfs send' stream is
+// re-read from the start and parts matching those already uploaded are skipped rather than uploaded again.
+type resumption struct {
+	mu    sync.Mutex
+	file  string
+	state uploadState
+}
+
+// uploadState identifies the stream of an upload and the multi-part uploads of its volumes.
+type uploadState struct {
+	Bucket     string                 `json:"bucket"`
+	Path       string                 `json:"path"`
+	Source     string                 `json:"source,omitempty"`
+	Target     string                 `json:"target"`
+	Identity   string                 `json:"identity"`
+	PartSize   int                    `json:"partSize"`
+	VolumeSize int                    `json:"volumeSize"`
+	Volumes    map[string]volumeState `json:"volumes"`
+}
+
+type volumeState struct {
+	Key        string               `json:"key"`
+	Identifier string               `json:"identifier"`
+	Parts      map[string]partState `json:"parts"`
+}
+
+type partState struct {
+	Tag  string `json:"tag"`
+	Hash string `json:"hash"`
+	Size int    `json:"size"`
+}
+
+// resumeFile names the file holding the progress of an upload to a path in the destination's bucket.
+func resumeFile(directory string, entry SendEntry, path string) string {
+	name := invalidFileName.ReplaceAllString(strings.Join([]string{entry.Endpoint, entry.Bucket, path}, "_"), "_")
+	return filepath.Join(directory, name+".json")
+}
+
+// newResumption starts recording the progress of an upload.
+func newResumption(file string, state uploadState) *resumption {
+	state.Volumes = make(map[string]volumeState)
+	return &resumption{
+		file:  file,
+		state: state,
+	}
+}
+
+// loadResumption reads the progress of an interrupted upload. Nil is returned if there is none.
+func loadResumption(file string) (*resumption, error) {
+	raw, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read upload state '%s' (%w)", file, err)
+	}
+
+	var state uploadState
+	if err := json.Unmarshal(raw, &state); err != nil {
+		return nil, fmt.Errorf("unable to parse upload state '%s' (%w)", file, err)
+	}
+
+	if state.Volumes == nil {
+		state.Volumes = make(map[string]volumeState)
+	}
+	return &resumption{file: file, state: state}, nil
+}
+
+// matches determines whether the interrupted upload can be continued by an upload of the same stream and layout.
+func (r *resumption) matches(state uploadState) bool {
+	return r.state.Bucket == state.Bucket &&
+		r.state.Path == state.Path &&
+		r.state.Source == state.Source &&
+		r.state.Identity == state.Identity &&
+		r.state.PartSize == state.PartSize &&
+		r.state.VolumeSize == state.VolumeSize
+}
+
+// volume retrieves the multi-part upload of an interrupted volume.
+func (r *resumption) volume(sequence int) (volumeState, bool) {
+	if r == nil {
+		return volumeState{}, false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	v, ok := r.state.Volumes[strconv.Itoa(sequence)]
+	return v, ok
+}
+
+func (r *resumption) addVolume(sequence int, key, identifier string) error {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.state.Volumes[strconv.Itoa(sequence)] = volumeState{Key: key, Identifier: identifier, Parts: make(map[string]partState)}
+	return r.save()
+}
+
+// part retrieves a part uploaded before the interruption.
+func (r *resumption) part(sequence, number int) (partState, bool) {
+	if r == nil {
+		return partState{}, false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	p, ok := r.state.Volumes[strconv.Itoa(sequence)].Parts[strconv.Itoa(number)]
+	return p, ok
+}
+
+func (r *resumption) addPart(sequence, number int, part partState) error {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	v, ok := r.state.Volumes[strconv.Itoa(sequence)]
+	if !ok {
+		return fmt.Errorf("volume %d of %s is not recorded", sequence, r.state.Path)
+	}
+	v.Parts[strconv.Itoa(number)] = part
+	return r.save()
+}
+
+// save replaces the file atomically. The lock must be held.
+func (r *resumption) save() error {
+	raw, err := json.Marshal(r.state)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(r.file), 0700); err != nil {
+		return fmt.Errorf("unable to write upload state (%w)", err)
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(r.file), ".snapr-upload-")
+	if err != nil {
+		return fmt.Errorf("unable to write upload state (%w)", err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(raw); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to write upload state (%w)", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("unable to write upload state (%w)", err)
+	}
+
+	if err := os.Rename(f.Name(), r.file); err != nil {
+		return fmt.Errorf("unable to write upload state (%w)", err)
+	}
+	return nil
+}
+
+// remove discards the progress once the upload has completed or been aborted.
+func (r *resumption) remove() {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := os.Remove(r.file); err != nil && !os.IsNotExist(err) {
+		Logger.Warn().Msgf("failed to remove upload state '%s': %s", r.file, err)
+	}
+}
@@ -0,0 +1,201 @@
+package snapr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"snapr/internal/stow"
+	"snapr/internal/stow/stowtest"
+	"snapr/internal/zed"
+	"snapr/internal/zed/zedtest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failParts fails part uploads once the given number have succeeded. It returns a function reporting the number of
+// parts uploaded.
+func failParts(provider *stowtest.Provider, succeed int) func() int {
+	var mu sync.Mutex
+	uploaded := 0
+
+	provider.Fail = func(req *http.Request) error {
+		if req.Method != http.MethodPut || req.URL.Query().Get("uploadId") == "" {
+			return nil
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if succeed >= 0 && uploaded >= succeed {
+			return &stow.StatusError{StatusCode: http.StatusForbidden}
+		}
+		uploaded++
+		return nil
+	}
+
+	return func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return uploaded
+	}
+}
+
+func TestResumeUpload(t *testing.T) {
+	fs := zed.FileSystem{Pool: "pool-0", Name: "test"}
+	directory, err := ioutil.TempDir("", "snapr")
+	require.NoError(t, err)
+	defer os.RemoveAll(directory)
+
+	local := zedtest.New()
+	testClock(local)
+	require.NoError(t, local.CreateFileSystem(fs))
+	require.NoError(t, local.Write(fs, testData(1, 5*Megabyte)))
+
+	settings := testSettings(fs.String())
+	settings.Threads = 1
+	settings.Resume = directory
+
+	provider := stowtest.New(testEndpoint)
+	s := testSnapr(t, local, provider, settings)
+	require.NoError(t, s.Snap().Err())
+
+	// The upload is interrupted after three parts and left in place.
+	failParts(provider, 3)
+	require.Error(t, s.Send().Err())
+	assert.NotZero(t, provider.Uploads())
+
+	file := resumeFile(directory, settings.FileSystems[fs.String()].Send[0], "pool-0/test/00000")
+	interrupted, err := loadResumption(file)
+	require.NoError(t, err)
+	require.NotNil(t, interrupted)
+	assert.Equal(t, "pool-0/test@daily-00000", interrupted.state.Target)
+
+	// A newer snapshot doesn't prevent the interrupted upload from being resumed.
+	require.NoError(t, local.CreateSnapshot(context.Background(), zed.Snapshot{Addr: zed.Address{FileSystem: fs, Name: "daily-00001"}}))
+
+	uploaded := failParts(provider, -1)
+	require.NoError(t, s.Send().Err())
+	assert.Zero(t, provider.Uploads())
+
+	parts := 0
+	for _, v := range interrupted.state.Volumes {
+		parts += len(v.Parts)
+	}
+	assert.Equal(t, 3, parts)
+
+	total := 0
+	for _, key := range provider.Keys("bucket") {
+		if filepath.Base(key) != "contents" {
+			data, _ := provider.Object("bucket", key)
+			total += (len(data) + Megabyte - 1) / Megabyte
+		}
+	}
+	assert.Equal(t, total-parts, uploaded(), "parts uploaded before the interruption are skipped")
+
+	raw, ok := provider.Object("bucket", "pool-0/test/00000/contents")
+	require.True(t, ok)
+	var entries []ArchiveEntry
+	require.NoError(t, json.Unmarshal(raw, &entries))
+	assert.Equal(t, "daily-00000", entries[len(entries)-1].Name)
+
+	_, err = ioutil.ReadFile(file)
+	assert.True(t, err != nil, "the upload state is removed once complete")
+
+	// The newer snapshot follows in the next archive.
+	require.NoError(t, s.Send().Err())
+	assert.Contains(t, provider.Keys("bucket"), "pool-0/test/00001/contents")
+}
+
+func TestResumeDiverged(t *testing.T) {
+	fs := zed.FileSystem{Pool: "pool-0", Name: "test"}
+	directory, err := ioutil.TempDir("", "snapr")
+	require.NoError(t, err)
+	defer os.RemoveAll(directory)
+
+	local := zedtest.New()
+	testClock(local)
+	require.NoError(t, local.CreateFileSystem(fs))
+	require.NoError(t, local.Write(fs, testData(1, 5*Megabyte)))
+
+	settings := testSettings(fs.String())
+	settings.Threads = 1
+	settings.Resume = directory
+
+	provider := stowtest.New(testEndpoint)
+	s := testSnapr(t, local, provider, settings)
+	require.NoError(t, s.Snap().Err())
+
+	failParts(provider, 2)
+	require.Error(t, s.Send().Err())
+
+	// The recorded parts no longer match the stream.
+	file := resumeFile(directory, settings.FileSystems[fs.String()].Send[0], "pool-0/test/00000")
+	interrupted, err := loadResumption(file)
+	require.NoError(t, err)
+	for _, v := range interrupted.state.Volumes {
+		for number, part := range v.Parts {
+			part.Hash = "changed"
+			v.Parts[number] = part
+		}
+	}
+	require.NoError(t, interrupted.save())
+
+	failParts(provider, -1)
+	report := s.Send()
+	require.Len(t, report.Results, 1)
+	assert.True(t, errors.Is(report.Results[0].Err, errDiverged))
+	assert.Zero(t, provider.Uploads(), "the diverged upload is aborted")
+
+	// The next send starts again.
+	require.NoError(t, s.Send().Err())
+	assert.Contains(t, provider.Keys("bucket"), "pool-0/test/00000/contents")
+}
+
+func TestResumeMissing(t *testing.T) {
+	fs := zed.FileSystem{Pool: "pool-0", Name: "test"}
+	directory, err := ioutil.TempDir("", "snapr")
+	require.NoError(t, err)
+	defer os.RemoveAll(directory)
+
+	local := zedtest.New()
+	testClock(local)
+	require.NoError(t, local.CreateFileSystem(fs))
+	require.NoError(t, local.Write(fs, testData(1, 5*Megabyte)))
+
+	settings := testSettings(fs.String())
+	settings.Threads = 1
+	settings.Resume = directory
+
+	provider := stowtest.New(testEndpoint)
+	s := testSnapr(t, local, provider, settings)
+	require.NoError(t, s.Snap().Err())
+
+	failParts(provider, 3)
+	require.Error(t, s.Send().Err())
+
+	// The recorded multi-part uploads no longer exist (e.g. they were completed or expired by the provider).
+	file := resumeFile(directory, settings.FileSystems[fs.String()].Send[0], "pool-0/test/00000")
+	interrupted, err := loadResumption(file)
+	require.NoError(t, err)
+	for number, v := range interrupted.state.Volumes {
+		v.Identifier = "missing-" + number
+		interrupted.state.Volumes[number] = v
+	}
+	require.NoError(t, interrupted.save())
+
+	failParts(provider, -1)
+	require.Error(t, s.Send().Err())
+
+	_, err = ioutil.ReadFile(file)
+	assert.True(t, os.IsNotExist(err), "the abandoned upload state is removed")
+
+	// The next send starts again.
+	require.NoError(t, s.Send().Err())
+	assert.Contains(t, provider.Keys("bucket"), "pool-0/test/00000/contents")
+}
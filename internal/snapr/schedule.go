@@ -0,0 +1,326 @@
+package snapr
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var weekdayNames = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+var monthNames = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+var cronShortcuts = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var calendarShortcuts = map[string]string{
+	"minutely":     "*-*-* *:*:00",
+	"hourly":       "*-*-* *:00:00",
+	"daily":        "*-*-* 00:00:00",
+	"weekly":       "Mon *-*-* 00:00:00",
+	"monthly":      "*-*-01 00:00:00",
+	"quarterly":    "*-01,04,07,10-01 00:00:00",
+	"semiannually": "*-01,07-01 00:00:00",
+	"yearly":       "*-01-01 00:00:00",
+	"annually":     "*-01-01 00:00:00",
+}
+
+// horizon limits how far ahead the next occurrence of a schedule is searched for.
+const horizon = 8 * 366 * 24 * time.Hour
+
+// field is a set of permitted values for a calendar component.
+type field uint64
+
+func (f field) has(v int) bool {
+	return f&(1<<uint(v)) != 0
+}
+
+func span(min, max int) field {
+	var f field
+	for i := min; i <= max; i++ {
+		f |= 1 << uint(i)
+	}
+	return f
+}
+
+// schedule is a calendar expression evaluated with a resolution of one minute in local time.
+type schedule struct {
+	years    map[int]bool
+	months   field
+	days     field
+	weekdays field
+	hours    field
+	minutes  field
+	either   bool
+}
+
+// parseSchedule parses either a cron expression (e.g. '0 18 * * 1-5') or a systemd calendar event (e.g. 'Mon..Fri 18:00').
+func parseSchedule(expression string) (*schedule, error) {
+	expression = strings.TrimSpace(expression)
+	if cron, ok := cronShortcuts[strings.ToLower(expression)]; ok {
+		return parseCron(cron)
+	}
+
+	if len(strings.Fields(expression)) == 5 && !strings.Contains(expression, ":") {
+		return parseCron(expression)
+	}
+	return parseCalendar(expression)
+}
+
+func parseCron(expression string) (*schedule, error) {
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields in '%s'", expression)
+	}
+
+	var err error
+	s := &schedule{}
+	if s.minutes, err = parseField(fields[0], 0, 59, "-", nil); err != nil {
+		return nil, err
+	}
+	if s.hours, err = parseField(fields[1], 0, 23, "-", nil); err != nil {
+		return nil, err
+	}
+	if s.days, err = parseField(fields[2], 1, 31, "-", nil); err != nil {
+		return nil, err
+	}
+	if s.months, err = parseField(fields[3], 1, 12, "-", monthNames); err != nil {
+		return nil, err
+	}
+	if s.weekdays, err = parseField(fields[4], 0, 7, "-", weekdayNames); err != nil {
+		return nil, err
+	}
+
+	if s.weekdays.has(7) {
+		s.weekdays |= 1
+	}
+
+	// Cron matches either the day of month or the day of week when both are restricted.
+	s.either = fields[2] != "*" && fields[4] != "*"
+	return s, nil
+}
+
+func parseCalendar(expression string) (*schedule, error) {
+	if shortcut, ok := calendarShortcuts[strings.ToLower(expression)]; ok {
+		expression = shortcut
+	}
+
+	s := &schedule{
+		months:   span(1, 12),
+		days:     span(1, 31),
+		weekdays: span(0, 6),
+		hours:    span(0, 0),
+		minutes:  span(0, 0),
+	}
+
+	parts := strings.Fields(expression)
+	if len(parts) == 0 || len(parts) > 3 {
+		return nil, fmt.Errorf("could not parse calendar event '%s'", expression)
+	}
+
+	var err error
+	if !strings.ContainsAny(parts[0][:1], "0123456789*") {
+		if s.weekdays, err = parseField(strings.ToLower(parts[0]), 0, 6, "..", weekdayNames); err != nil {
+			return nil, err
+		}
+		parts = parts[1:]
+	}
+
+	for _, part := range parts {
+		switch {
+		case strings.Contains(part, ":"):
+			err = s.parseTime(part)
+		case strings.Contains(part, "-"):
+			err = s.parseDate(part)
+		default:
+			err = fmt.Errorf("unexpected component '%s'", part)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not parse calendar event '%s': %w", expression, err)
+		}
+	}
+	return s, nil
+}
+
+func (s *schedule) parseDate(date string) error {
+	components := strings.Split(date, "-")
+	if len(components) == 2 {
+		components = append([]string{"*"}, components...)
+	}
+
+	if len(components) != 3 {
+		return fmt.Errorf("invalid date '%s'", date)
+	}
+
+	var err error
+	if components[0] != "*" {
+		if s.years, err = parseYears(components[0]); err != nil {
+			return err
+		}
+	}
+
+	if s.months, err = parseField(components[1], 1, 12, "..", nil); err != nil {
+		return err
+	}
+	s.days, err = parseField(components[2], 1, 31, "..", nil)
+	return err
+}
+
+func (s *schedule) parseTime(clock string) error {
+	components := strings.Split(clock, ":")
+	if len(components) < 2 || len(components) > 3 {
+		return fmt.Errorf("invalid time '%s'", clock)
+	}
+
+	if len(components) == 3 && components[2] != "00" && components[2] != "0" {
+		return fmt.Errorf("seconds are not supported in '%s'", clock)
+	}
+
+	var err error
+	if s.hours, err = parseField(components[0], 0, 23, "..", nil); err != nil {
+		return err
+	}
+	s.minutes, err = parseField(components[1], 0, 59, "..", nil)
+	return err
+}
+
+func parseYears(text string) (map[int]bool, error) {
+	years := make(map[int]bool)
+	for _, item := range strings.Split(text, ",") {
+		bounds := strings.SplitN(item, "..", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid year '%s'", item)
+		}
+
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil || last < first {
+				return nil, fmt.Errorf("invalid year range '%s'", item)
+			}
+		}
+
+		for i := first; i <= last; i++ {
+			years[i] = true
+		}
+	}
+	return years, nil
+}
+
+// parseField parses a comma separated list of values, ranges, and steps.
+func parseField(text string, min, max int, through string, names map[string]int) (field, error) {
+	value := func(v string) (int, error) {
+		if n, ok := names[strings.ToLower(v)]; ok {
+			return n, nil
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, fmt.Errorf("invalid value '%s'", v)
+		}
+		if n < min || n > max {
+			return 0, fmt.Errorf("value '%s' out of range", v)
+		}
+		return n, nil
+	}
+
+	var f field
+	for _, item := range strings.Split(text, ",") {
+		increment := 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			n, err := strconv.Atoi(item[i+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step in '%s'", item)
+			}
+			increment = n
+			item = item[:i]
+		}
+
+		first, last := min, max
+		switch {
+		case item == "*":
+		case strings.Contains(item, through):
+			bounds := strings.SplitN(item, through, 2)
+			var err error
+			if first, err = value(bounds[0]); err != nil {
+				return 0, err
+			}
+			if last, err = value(bounds[1]); err != nil {
+				return 0, err
+			}
+			if last < first {
+				return 0, fmt.Errorf("invalid range '%s'", item)
+			}
+		default:
+			n, err := value(item)
+			if err != nil {
+				return 0, err
+			}
+			first = n
+			if increment == 1 {
+				last = n
+			}
+		}
+
+		for i := first; i <= last; i += increment {
+			f |= 1 << uint(i)
+		}
+	}
+	return f, nil
+}
+
+func (s *schedule) matchesDay(t time.Time) bool {
+	day := s.days.has(t.Day())
+	weekday := s.weekdays.has(int(t.Weekday()))
+	if s.either {
+		return day || weekday
+	}
+	return day && weekday
+}
+
+// next returns the first occurrence strictly after the given time or a zero time if there is none.
+func (s *schedule) next(after time.Time) time.Time {
+	t := after.Local().Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(horizon)
+
+	for t.Before(limit) {
+		if s.years != nil && !s.years[t.Year()] {
+			t = time.Date(t.Year()+1, time.January, 1, 0, 0, 0, 0, time.Local)
+			continue
+		}
+
+		if !s.months.has(int(t.Month())) {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.Local)
+			continue
+		}
+
+		if !s.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.Local)
+			continue
+		}
+
+		if !s.hours.has(t.Hour()) {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, time.Local)
+			continue
+		}
+
+		if !s.minutes.has(t.Minute()) {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
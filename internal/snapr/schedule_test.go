@@ -0,0 +1,52 @@
+package snapr
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScheduleNext(t *testing.T) {
+	// Wednesday 6 October 2021.
+	from := time.Date(2021, time.October, 6, 21, 11, 0, 0, time.Local)
+
+	tests := []struct {
+		expression string
+		expected   time.Time
+	}{
+		{"0 0 * * *", time.Date(2021, time.October, 7, 0, 0, 0, 0, time.Local)},
+		{"@hourly", time.Date(2021, time.October, 6, 22, 0, 0, 0, time.Local)},
+		{"*/15 * * * *", time.Date(2021, time.October, 6, 21, 15, 0, 0, time.Local)},
+		{"0 18 * * mon-fri", time.Date(2021, time.October, 7, 18, 0, 0, 0, time.Local)},
+		{"30 2 1 jan,jul *", time.Date(2022, time.January, 1, 2, 30, 0, 0, time.Local)},
+		{"0 0 13 * 5", time.Date(2021, time.October, 8, 0, 0, 0, 0, time.Local)},
+		{"daily", time.Date(2021, time.October, 7, 0, 0, 0, 0, time.Local)},
+		{"weekly", time.Date(2021, time.October, 11, 0, 0, 0, 0, time.Local)},
+		{"Mon..Fri 18:00", time.Date(2021, time.October, 7, 18, 0, 0, 0, time.Local)},
+		{"Sat,Sun *-*-* 09:30:00", time.Date(2021, time.October, 9, 9, 30, 0, 0, time.Local)},
+		{"*-*-01 00:00", time.Date(2021, time.November, 1, 0, 0, 0, 0, time.Local)},
+		{"2022-02-14 12:00", time.Date(2022, time.February, 14, 12, 0, 0, 0, time.Local)},
+		{"*:0/20", time.Date(2021, time.October, 6, 21, 20, 0, 0, time.Local)},
+	}
+
+	for _, test := range tests {
+		schedule, err := parseSchedule(test.expression)
+		if assert.NoError(t, err, test.expression) {
+			assert.Equal(t, test.expected, schedule.next(from), test.expression)
+		}
+	}
+}
+
+func TestScheduleInvalid(t *testing.T) {
+	for _, expression := range []string{"", "0 0 * *", "61 * * * *", "Funday 12:00", "*-*-* 12:00:30", "0 0 32 * *"} {
+		_, err := parseSchedule(expression)
+		assert.Error(t, err, expression)
+	}
+}
+
+func TestScheduleNever(t *testing.T) {
+	schedule, err := parseSchedule("0 0 30 2 *")
+	assert.NoError(t, err)
+	assert.True(t, schedule.next(time.Now()).IsZero())
+}
@@ -2,13 +2,22 @@ package snapr
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"snapr/internal/stow"
 	"snapr/internal/zed"
+	"sort"
+	"sync"
 )
 
 type sender struct {
 	ctx      context.Context
-	zed      *zed.Zed
+	zed      zed.ZFS
 	settings *Settings
+	stow     []stow.SetOption
+	plan     *plan
+	metrics  *metrics
+	budget   *budget
 }
 
 func (s *Snapr) newSender() *sender {
@@ -16,6 +25,10 @@ func (s *Snapr) newSender() *sender {
 		s.ctx,
 		s.zed,
 		s.settings,
+		s.stow,
+		s.plan,
+		s.metrics,
+		s.budget,
 	}
 }
 
@@ -27,32 +40,309 @@ func (s *sender) entries() map[string][]SendEntry {
 	return targets
 }
 
-// Send performs uploads as per configuration.
-func (s *sender) Send() {
-	for target, entries := range s.entries() {
-		if len(entries) == 0 {
-			Logger.Warn().Msgf("sending failed for %s: no sends", target)
+// Send performs uploads as per configuration. A result is returned for each destination. Up to the configured number
+// of file systems are sent at once while the destinations of a file system are sent in order, so the same prefix of a
+// bucket is never written by two sends at once. Results are ordered by file system regardless of completion order.
+func (s *sender) Send() []Result {
+	entries := s.entries()
+
+	targets := make([]string, 0, len(entries))
+	for target := range entries {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+
+	concurrency := s.settings.Concurrency
+	if concurrency < 1 || s.plan != nil {
+		concurrency = 1
+	}
+
+	grouped := make([][]Result, len(targets))
+	slots := make(chan struct{}, concurrency)
+
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		slots <- struct{}{}
+		wg.Add(1)
+
+		go func(i int, target string) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			grouped[i] = s.sendFileSystem(target, entries[target])
+		}(i, target)
+	}
+	wg.Wait()
+
+	results := make([]Result, 0)
+	for _, v := range grouped {
+		results = append(results, v...)
+	}
+	return results
+}
+
+// sendFileSystem sends a file system to each of its destinations in turn. Destinations which would be sent the same
+// stream share a single 'zfs send'. Those which fail to receive the shared stream are then sent their own.
+func (s *sender) sendFileSystem(target string, entries []SendEntry) []Result {
+	if len(entries) == 0 {
+		Logger.Warn().Msgf("sending failed for %s: no sends", target)
+		return []Result{{FileSystem: target, Err: errors.New("no sends")}}
+	}
+
+	results := make([]Result, len(entries))
+	sent := make([]bool, len(entries))
+
+	if len(entries) > 1 && s.plan == nil {
+		for i, result := range s.sendShared(target, entries) {
+			results[i] = result
+			sent[i] = true
+		}
+	}
+
+	for i, entry := range entries {
+		if !sent[i] {
+			results[i] = s.sendResult(target, entry)
+		}
+	}
+	return results
+}
+
+// member is a destination sharing a stream with others.
+type member struct {
+	index    int
+	entry    SendEntry
+	remote   *remote
+	transfer *transfer
+	details  *SendDetails
+	err      error
+}
+
+// sendShared prepares each destination and sends destinations which share a stream together. Results are returned for
+// the destinations which were sent or are up to date, keyed by their index. The others are left to be sent separately.
+func (s *sender) sendShared(target string, entries []SendEntry) map[int]Result {
+	results := make(map[int]Result)
+
+	fs, err := zed.ToFileSystem(target)
+	if err != nil {
+		return results
+	}
+
+	streams := make([]string, 0)
+	grouped := make(map[string][]*member)
+	for i, entry := range entries {
+		remote, err := s.newRemote(entry)
+		if err != nil {
 			continue
 		}
 
-		fs, err := zed.ToFileSystem(target)
+		t, err := remote.prepare(*fs)
+		if err == errUpToDate {
+			results[i] = s.result(target, entry, nil, err)
+			continue
+		}
 		if err != nil {
-			Logger.Warn().Msgf("sending failed for %s: %s", target, err)
 			continue
 		}
 
-		for _, entry := range entries {
-			remote, err := newRemote(s.ctx, s.zed, entry.Inherit(s.settings))
-			if err != nil {
-				Logger.Warn().Msgf("sending failed for %s: %s", target, err)
+		// Entries writing to the same prefix of a bucket are left to be sent one after another.
+		if shares(grouped[t.stream()], entry) {
+			continue
+		}
+
+		if _, ok := grouped[t.stream()]; !ok {
+			streams = append(streams, t.stream())
+		}
+		grouped[t.stream()] = append(grouped[t.stream()], &member{index: i, entry: entry, remote: remote, transfer: t})
+	}
+
+	for _, stream := range streams {
+		members := grouped[stream]
+		if len(members) < 2 {
+			m := members[0]
+			m.details, m.err = m.remote.send(m.transfer)
+			s.record(target, m.entry, m.details, m.err)
+			results[m.index] = s.result(target, m.entry, m.details, m.err)
+			continue
+		}
+
+		Logger.Info().Msgf("sending %s to %d destinations from a single stream", stream, len(members))
+		s.tee(members)
+
+		for _, m := range members {
+			if m.err != nil {
+				Logger.Warn().Msgf("shared send of %s to %s failed, sending separately: %s", target, m.entry.destination(), m.err)
 				continue
 			}
+			s.record(target, m.entry, m.details, nil)
+			results[m.index] = s.result(target, m.entry, m.details, nil)
+		}
+	}
+	return results
+}
+
+// shares indicates whether a member sends to the same destination as the entry.
+func shares(members []*member, entry SendEntry) bool {
+	for _, m := range members {
+		if m.entry.destination() == entry.destination() {
+			return true
+		}
+	}
+	return false
+}
+
+// tee uploads a single stream to each member. The members divide their threads between them. The first member waits for
+// the upload budget while the others are left unsent if the budget is exhausted or their threads wouldn't fit within the
+// global threads. The threads of every member are held before the stream starts, as a member waiting for a thread would
+// fall behind and be detached. Each member's error is set if its upload failed.
+func (s *sender) tee(members []*member) {
+	active := make([]*member, 0, len(members))
+	uploads := make([]*upload, 0, len(members))
+	threads := 0
+	for i, m := range members {
+		upload, err := m.remote.newUpload(m.transfer, len(members), i == 0)
+		if err != nil {
+			m.err = err
+			continue
+		}
+
+		if !s.budget.fits(threads + cap(upload.free)) {
+			upload.close()
+			m.err = errExhausted
+			continue
+		}
+
+		threads += cap(upload.free)
+		active = append(active, m)
+		uploads = append(uploads, upload)
+	}
+
+	if len(active) == 0 {
+		return
+	}
+
+	if err := s.budget.hold(s.ctx, threads); err != nil {
+		for i, m := range active {
+			m.err = err
+			uploads[i].close()
+		}
+		return
+	}
+
+	defer s.budget.unhold(threads)
+
+	for _, upload := range uploads {
+		upload.held = true
+	}
+
+	t := active[0].transfer
+	stream, err := s.zed.Send(s.ctx, t.source, t.target, nil)
+	if err != nil {
+		for i, m := range active {
+			m.err = uploads[i].Fail(true, err)
+			uploads[i].close()
+		}
+		return
+	}
+
+	defer stream.Out.Close()
+
+	fanOut := newTee(stream.Out, len(active), TeeStall)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		fanOut.run()
+	}()
+
+	for i, m := range active {
+		wg.Add(1)
+		go func(i int, m *member) {
+			defer wg.Done()
+
+			src := fanOut.reader(i)
+			m.details, m.err = m.remote.store(m.transfer, uploads[i], src)
+			if m.err != nil {
+				src.CloseWithError(m.err)
+			}
+		}(i, m)
+	}
+	wg.Wait()
 
-			if err := remote.refresh(*fs); err != nil {
-				Logger.Warn().Msgf("sending failed for %s: %s", target, err)
-			} else {
-				Logger.Info().Msgf("sending successful for %s", target)
+	if err := stream.Wait(); err != nil {
+		for _, m := range active {
+			if m.err == nil {
+				m.err = err
 			}
 		}
+		return
+	}
+
+	for _, m := range active {
+		if m.err == nil {
+			m.remote.release(m.transfer.released)
+			m.remote.finish(m.transfer, m.details)
+		}
+	}
+}
+
+// sendResult sends to a destination and logs the result.
+func (s *sender) sendResult(target string, entry SendEntry) Result {
+	details, err := s.send(target, entry)
+	return s.result(target, entry, details, err)
+}
+
+// result logs the outcome of a send to a destination.
+func (s *sender) result(target string, entry SendEntry, details *SendDetails, err error) Result {
+	result := Result{FileSystem: target, Destination: entry.destination()}
+
+	switch {
+	case err == errUpToDate:
+		Logger.Info().Msgf("sending skipped for %s: %s", target, err)
+		result.Detail = err.Error()
+	case err != nil:
+		Logger.Warn().Msgf("sending failed for %s: %s", target, err)
+		result.Err = err
+	case details != nil:
+		Logger.Info().Msgf("sending successful for %s", target)
+		result.Detail = fmt.Sprintf("sent %s to %s", formatSize(int64(details.Bytes)), details.Path)
+	}
+	return result
+}
+
+// send uploads new snapshots of a single file system to a destination. The outcome is recorded in the metrics.
+func (s *sender) send(target string, entry SendEntry) (*SendDetails, error) {
+	details, err := s.upload(target, entry)
+	s.record(target, entry, details, err)
+	return details, err
+}
+
+func (s *sender) record(target string, entry SendEntry, details *SendDetails, err error) {
+	if s.plan == nil && err != errUpToDate {
+		s.metrics.recordSend(target, entry, details, err)
+	}
+}
+
+func (s *sender) upload(target string, entry SendEntry) (*SendDetails, error) {
+	fs, err := zed.ToFileSystem(target)
+	if err != nil {
+		return nil, err
+	}
+
+	remote, err := s.newRemote(entry)
+	if err != nil {
+		return nil, err
+	}
+	return remote.refresh(*fs)
+}
+
+func (s *sender) newRemote(entry SendEntry) (*remote, error) {
+	remote, err := newRemote(s.ctx, s.zed, entry.Inherit(s.settings), s.plan, s.stow...)
+	if err != nil {
+		return nil, err
 	}
+	remote.budget = s.budget
+	remote.resume = s.settings.Resume
+	return remote, nil
 }
@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"os"
 	"snapr/internal/stow"
+	"snapr/internal/zed"
 	"time"
 )
 
@@ -19,13 +20,37 @@ type SendArguments struct {
 	Active bool
 }
 
+// PruneArguments holds options for running prune.
+type PruneArguments struct {
+	Active bool
+}
+
 // RestoreArguments holds options for running restore.
 type RestoreArguments struct {
+	Active      bool
+	Target      string
+	Snapshot    string
+	Archive     int
+	Rollback    bool
+	Destination string
+	Fallback    bool
+	Receive     ReceiveOverrides
+}
+
+// StatusArguments holds options for reporting status.
+type StatusArguments struct {
+	Active bool
+	Format string
+}
+
+// DaemonArguments holds options for running as a daemon.
+type DaemonArguments struct {
 	Active bool
 }
 
 // SendEntry holds options for running restore.
 type SendEntry struct {
+	Name       string
 	Endpoint   string
 	Region     string
 	Account    string
@@ -35,13 +60,59 @@ type SendEntry struct {
 	Threads    int
 	VolumeSize int
 	PartSize   int
+	Schedule   string
 }
 
 // SnapEntry holds options for a snapshot schedule.
 type SnapEntry struct {
-	Interval string
-	Prefix   string
-	Hold     []string
+	Interval  string
+	Schedule  string
+	Prefix    string
+	Template  string
+	Hold      []string
+	Retain    Retention
+	Recursive bool
+	Exclude   []string
+	Pre       Hook
+	Post      Hook
+}
+
+// Hook holds a shell command which is run before or after a snapshot is created.
+type Hook struct {
+	Command string
+	Timeout string
+}
+
+// TimeoutDuration will retrieve the timeout as a duration.
+func (h Hook) TimeoutDuration() (time.Duration, error) {
+	if h.Timeout == "" {
+		return HookTimeout, nil
+	}
+	return time.ParseDuration(h.Timeout)
+}
+
+// Retention holds the rules used to prune snapshots created by a snap entry. A snapshot is kept if any rule retains it.
+type Retention struct {
+	Last    int
+	Within  string
+	Hourly  int
+	Daily   int
+	Weekly  int
+	Monthly int
+	Yearly  int
+}
+
+// Active indicates whether any retention rule has been set.
+func (r Retention) Active() bool {
+	return r.Last > 0 || r.Within != "" || r.Hourly > 0 || r.Daily > 0 || r.Weekly > 0 || r.Monthly > 0 || r.Yearly > 0
+}
+
+// WithinDuration will retrieve the within rule as a duration.
+func (r Retention) WithinDuration() (time.Duration, error) {
+	if r.Within == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(r.Within)
 }
 
 // IntervalDuration will retrieve the interval as a duration.
@@ -73,9 +144,9 @@ func (e SendEntry) Validate() error {
 	return nil
 }
 
-// Inherit will inherit unset values from the parent.
+// Inherit will inherit unset values from the parent. The threads are limited to the global threads.
 func (e SendEntry) Inherit(settings *Settings) SendEntry {
-	if e.Threads == 0 {
+	if e.Threads == 0 || (settings.Threads > 0 && e.Threads > settings.Threads) {
 		e.Threads = settings.Threads
 	}
 	if e.VolumeSize == 0 {
@@ -87,13 +158,15 @@ func (e SendEntry) Inherit(settings *Settings) SendEntry {
 	return e
 }
 
-// NewStow creates a stow instance from the stored fields.
-func (e SendEntry) NewStow() (*stow.Stow, error) {
-	settings, err := stow.NewSettings(
+// NewStow creates a stow instance from the stored fields. Any overrides are applied after the stored fields.
+func (e SendEntry) NewStow(overrides ...stow.SetOption) (*stow.Stow, error) {
+	options := []stow.SetOption{
 		stow.Use(e.Endpoint, e.Region),
 		stow.WithCredentials(e.Account, e.Secret),
 		stow.WithLogger(Logger),
-	)
+	}
+
+	settings, err := stow.NewSettings(append(options, overrides...)...)
 	if err != nil {
 		return nil, err
 	}
@@ -106,20 +179,53 @@ type Settings struct {
 	Threads     int
 	VolumeSize  int
 	PartSize    int
+	Concurrency int
+	Memory      int
+	Resume      string
+	Metrics     string
+	Notify      NotifySettings
+}
+
+// NotifyAlways sends a notification after every run rather than only after failures.
+const NotifyAlways = "always"
+
+// NotifySettings holds where a summary of each run is sent. Notifications are sent on failure unless 'on' is 'always'.
+type NotifySettings struct {
+	On      string
+	Webhook Webhook
+	Email   Email
+}
+
+// Webhook holds a URL which is sent a JSON summary of each run.
+type Webhook struct {
+	URL     string
+	Headers map[string]string
+}
+
+// Email holds an SMTP server and recipients which are sent a summary of each run.
+type Email struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+	To       []string
 }
 
 // FileSystemSettings represent per file system settings.
 type FileSystemSettings struct {
-	Send []SendEntry
-	Snap []SnapEntry
+	Send    []SendEntry
+	Snap    []SnapEntry
+	Receive zed.ReceiveOptions
 }
 
 // NewSettings instantiates new settings with default values.
 func NewSettings() *Settings {
 	return &Settings{
-		Threads:    Threads,
-		VolumeSize: VolumeSize,
-		PartSize:   PartSize,
+		Threads:     Threads,
+		VolumeSize:  VolumeSize,
+		PartSize:    PartSize,
+		Concurrency: Concurrency,
 	}
 }
 
@@ -81,3 +81,8 @@ func TestReadSettings(t *testing.T) {
 	assert.Equal(t, "bucket", target.Send[0].Bucket)
 	assert.Equal(t, "backblaze", target.Send[0].Release[0])
 }
+
+func TestSendEntryStateProperty(t *testing.T) {
+	entry := SendEntry{Endpoint: "s3.us-west-000.Backblazeb2.com:443", Bucket: "my_bucket/x"}
+	assert.Equal(t, "s3.us-west-000.backblazeb2.com:443:my_bucket_x", entry.stateProperty())
+}
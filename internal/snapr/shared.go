@@ -3,6 +3,7 @@ package snapr
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/rs/zerolog"
 )
@@ -14,11 +15,29 @@ const (
 	// Threads is the default number of concurrent uploads.
 	Threads = 10
 
+	// Concurrency is the default number of file systems sent at once.
+	Concurrency = 1
+
 	// PartSize is the default part size in megabytes.
 	PartSize = 100_000
 
 	// VolumeSize is the default volume size in megabytes.
 	VolumeSize = 200
+
+	// TeeStall is how long a destination sharing a stream may fall behind the others before it's sent separately.
+	TeeStall = 5 * time.Minute
+
+	// HookTimeout is the default time a hook command is allowed to run.
+	HookTimeout = 5 * time.Minute
+
+	// NotifyTimeout is the time allowed to deliver notifications.
+	NotifyTimeout = 30 * time.Second
+
+	// DaemonPoll is the longest the daemon waits before re-evaluating which operations are due.
+	DaemonPoll = 10 * time.Minute
+
+	// DaemonRetry is how long the daemon waits before running operations on a file system again after one failed.
+	DaemonRetry = 5 * time.Minute
 )
 
 // Logger is the default logger for the package.
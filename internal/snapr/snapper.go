@@ -4,19 +4,20 @@ import (
 	"context"
 	"fmt"
 	"snapr/internal/zed"
-	"strconv"
 	"strings"
 	"time"
 )
 
 type snapper struct {
 	ctx      context.Context
-	zed      *zed.Zed
+	zed      zed.ZFS
 	settings *Settings
+	plan     *plan
+	metrics  *metrics
 }
 
 func (s *Snapr) newSnapper() snapper {
-	return snapper{s.ctx, s.zed, s.settings}
+	return snapper{s.ctx, s.zed, s.settings, s.plan, s.metrics}
 }
 
 func (s *snapper) entries() map[string][]SnapEntry {
@@ -27,55 +28,97 @@ func (s *snapper) entries() map[string][]SnapEntry {
 	return targets
 }
 
-func (s snapper) Snap() []string {
-	snapshots := make([]string, 0)
+func (s snapper) Snap() []Result {
+	results := make([]Result, 0)
 
 	for target, entries := range s.entries() {
-		if len(entries) == 0 {
-			Logger.Info().Msgf("skipping snapshot on '%s': no entries", target)
-			continue
-		}
+		results = append(results, s.snapFileSystem(target, entries)...)
+	}
+	return results
+}
 
-		fs, err := zed.ToFileSystem(target)
-		if err != nil {
-			Logger.Warn().Msgf("skipping snapshot on '%s': failed parsing file system (%s)", target, err)
-			continue
-		}
+// snapFileSystem creates the snapshots which are due for a single file system. A result is returned for each snapshot
+// created or which failed.
+func (s snapper) snapFileSystem(target string, entries []SnapEntry) []Result {
+	results := make([]Result, 0)
 
-		for _, entry := range entries {
-			if snapshot, err := s.snap(*fs, entry); err != nil {
-				Logger.Warn().Msgf("failed creating snapshot %s on '%s': %s", fs, entry.Prefix, err)
-			} else {
-				if snapshot != nil {
+	if len(entries) == 0 {
+		Logger.Info().Msgf("skipping snapshot on '%s': no entries", target)
+		return results
+	}
+
+	fs, err := zed.ToFileSystem(target)
+	if err != nil {
+		Logger.Warn().Msgf("skipping snapshot on '%s': failed parsing file system (%s)", target, err)
+		return append(results, Result{FileSystem: target, Err: err})
+	}
+
+	created, failed := 0, 0
+	for _, entry := range entries {
+		if snapshot, err := s.snap(*fs, entry); err != nil {
+			Logger.Warn().Msgf("failed creating snapshot %s on '%s': %s", fs, entry.Prefix, err)
+			results = append(results, Result{FileSystem: target, Err: err})
+			failed++
+		} else {
+			if snapshot != nil {
+				if s.plan == nil {
 					Logger.Info().Msgf("created snapshot '%s' on '%s'", snapshot.Address(), target)
-					snapshots = append(snapshots, snapshot.Address())
 				}
+				results = append(results, Result{FileSystem: target, Detail: fmt.Sprintf("created %s", snapshot.Address())})
+				created++
 			}
 		}
 	}
-	return snapshots
+
+	if s.plan == nil {
+		s.metrics.recordSnap(target, created, failed)
+	}
+	return results
 }
 
 func (s snapper) snap(fs zed.FileSystem, entry SnapEntry) (*zed.Snapshot, error) {
-	interval, err := entry.IntervalDuration()
+	listing, err := s.zed.ListSnapshots(s.ctx, fs)
 	if err != nil {
-		return nil, fmt.Errorf("could not parse interval '%s': %w", entry.Interval, err)
+		return nil, fmt.Errorf("failed to list snapshots for '%s': %w", fs, err)
 	}
 
-	listing, err := s.zed.ListSnapshots(s.ctx, fs)
+	template, err := entry.template()
 	if err != nil {
-		return nil, fmt.Errorf("failed to list snapshots for '%s': %w", fs, err)
+		return nil, err
 	}
 
-	if s.expired(entry.Prefix, interval, listing) {
-		snapshot := nextSnap(fs, entry.Prefix, listing)
-		if err = s.zed.CreateSnapshot(s.ctx, snapshot); err != nil {
+	now := time.Now()
+	if err := entry.unique(template, now); err != nil {
+		return nil, err
+	}
+
+	expired, err := s.expired(entry, template, listing, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if expired {
+		snapshot := nextSnap(fs, template, listing, now)
+		if s.plan != nil {
+			return &snapshot, s.planSnap(snapshot, entry)
+		}
+
+		if err := entry.Pre.run(s.ctx, hookEnvironment(snapshot, entry.Prefix)); err != nil {
+			s.post(snapshot, entry, err)
+			return nil, fmt.Errorf("aborted snapshot '%s': %w", snapshot.Address(), err)
+		}
+
+		created, err := s.create(snapshot, entry)
+		s.post(snapshot, entry, err)
+		if err != nil {
 			return nil, fmt.Errorf("failed to create snapshot '%s': %w", snapshot.Address(), err)
 		}
 
-		for _, tag := range entry.Hold {
-			if err = s.zed.HoldSnapshot(s.ctx, snapshot, tag); err != nil {
-				Logger.Warn().Err(err).Stack().Msgf("failed to apply hold '%s' to snapshot '%s'", tag, snapshot.Address())
+		for _, v := range created {
+			for _, tag := range entry.Hold {
+				if err = s.zed.HoldSnapshot(s.ctx, v, tag); err != nil {
+					Logger.Warn().Err(err).Stack().Msgf("failed to apply hold '%s' to snapshot '%s'", tag, v.Address())
+				}
 			}
 		}
 		return &snapshot, nil
@@ -83,20 +126,122 @@ func (s snapper) snap(fs zed.FileSystem, entry SnapEntry) (*zed.Snapshot, error)
 	return nil, nil
 }
 
-func nextSnap(fs zed.FileSystem, prefix string, listing []zed.SnapshotListing) zed.Snapshot {
-	token := prefix + "-"
+// post runs the post-snapshot hook regardless of the outcome and without regard to cancellation.
+func (s snapper) post(snapshot zed.Snapshot, entry SnapEntry, cause error) {
+	status := "success"
+	if cause != nil {
+		status = "failure"
+	}
+
+	env := append(hookEnvironment(snapshot, entry.Prefix), "SNAPR_STATUS="+status)
+	if err := entry.Post.run(context.Background(), env); err != nil {
+		Logger.Warn().Msgf("post-snapshot hook failed for '%s': %s", snapshot.Address(), err)
+	}
+}
+
+// planSnap records the snapshots which would be created without running hooks.
+func (s snapper) planSnap(snapshot zed.Snapshot, entry SnapEntry) error {
+	snapshots, err := s.targets(snapshot, entry)
+	if err != nil {
+		return err
+	}
 
+	details := make([]string, 0)
+	if entry.Pre.Command != "" {
+		details = append(details, fmt.Sprintf("pre-snapshot hook '%s'", entry.Pre.Command))
+	}
+
+	for _, v := range snapshots {
+		if v != snapshot {
+			details = append(details, fmt.Sprintf("include %s", v.Address()))
+		}
+		for _, tag := range entry.Hold {
+			details = append(details, fmt.Sprintf("hold '%s' on %s", tag, v.Address()))
+		}
+	}
+
+	if entry.Post.Command != "" {
+		details = append(details, fmt.Sprintf("post-snapshot hook '%s'", entry.Post.Command))
+	}
+
+	s.plan.add(fmt.Sprintf("snapshot %s", snapshot.Address()), details...)
+	return nil
+}
+
+// create takes the snapshot and, if the entry is recursive, the snapshots of all descendants which are not excluded.
+func (s snapper) create(snapshot zed.Snapshot, entry SnapEntry) ([]zed.Snapshot, error) {
+	snapshots, err := s.targets(snapshot, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	if !entry.Recursive {
+		return snapshots, s.zed.CreateSnapshot(s.ctx, snapshot)
+	}
+
+	if len(entry.Exclude) == 0 {
+		return snapshots, s.zed.CreateRecursiveSnapshot(s.ctx, snapshot)
+	}
+	return snapshots, s.zed.CreateSnapshots(s.ctx, snapshots)
+}
+
+// targets lists the snapshots which make up the snapshot of the entry.
+func (s snapper) targets(snapshot zed.Snapshot, entry SnapEntry) ([]zed.Snapshot, error) {
+	if !entry.Recursive {
+		if len(entry.Exclude) > 0 {
+			return nil, fmt.Errorf("exclusions require a recursive snapshot")
+		}
+		return []zed.Snapshot{snapshot}, nil
+	}
+
+	children, err := s.zed.ListFileSystems(s.ctx, snapshot.Addr.FileSystem)
+	if err != nil {
+		return nil, err
+	}
+	return descendants(snapshot, children, entry.Exclude)
+}
+
+// descendants lists the snapshot for each file system excluding the given children (relative to the snapshot's file system) and their descendants.
+func descendants(snapshot zed.Snapshot, children []zed.FileSystem, exclude []string) ([]zed.Snapshot, error) {
+	root := snapshot.Addr.FileSystem
+
+	excluded := make([]zed.FileSystem, 0, len(exclude))
+	for _, v := range exclude {
+		name := strings.Trim(v, "/")
+		if name == "" {
+			return nil, fmt.Errorf("invalid exclusion '%s'", v)
+		}
+		excluded = append(excluded, zed.FileSystem{Pool: root.Pool, Name: root.Name + "/" + name})
+	}
+
+	snapshots := make([]zed.Snapshot, 0, len(children))
+	for _, child := range children {
+		if !root.Contains(child) {
+			continue
+		}
+
+		skip := false
+		for _, v := range excluded {
+			if v.Contains(child) {
+				skip = true
+				break
+			}
+		}
+
+		if !skip {
+			snapshots = append(snapshots, zed.Snapshot{Addr: zed.Address{FileSystem: child, Name: snapshot.Addr.Name}})
+		}
+	}
+	return snapshots, nil
+}
+
+// nextSnap names the next snapshot using the template. The sequence follows the highest sequence found for the template.
+func nextSnap(fs zed.FileSystem, template *nameTemplate, listing []zed.SnapshotListing, now time.Time) zed.Snapshot {
 	last := -1
 	for _, v := range listing {
 		if v.Snapshot.Addr.FileSystem == fs {
-			split := strings.Split(v.Snapshot.Addr.Name, token)
-			if len(split) > 1 {
-				seq, err := strconv.Atoi(split[len(split)-1])
-				if err == nil {
-					if seq > last {
-						last = seq
-					}
-				}
+			if parsed, ok := template.parse(v.Snapshot.Addr.Name); ok && parsed.sequence > last {
+				last = parsed.sequence
 			}
 		}
 	}
@@ -104,19 +249,54 @@ func nextSnap(fs zed.FileSystem, prefix string, listing []zed.SnapshotListing) z
 	return zed.Snapshot{
 		Addr: zed.Address{
 			FileSystem: fs,
-			Name:       fmt.Sprintf("%s%s", token, padNumber(last+1)),
+			Name:       template.format(last+1, now),
 		},
 	}
 }
 
-func (s snapper) expired(prefix string, interval time.Duration, listing []zed.SnapshotListing) bool {
-	token := prefix + "-"
+func (s snapper) expired(entry SnapEntry, template *nameTemplate, listing []zed.SnapshotListing, now time.Time) (bool, error) {
+	due, ok, err := s.due(entry, template, listing)
+	if err != nil {
+		return false, err
+	}
+	return ok && !now.Before(due), nil
+}
+
+// due determines when the next snapshot for the entry should be created. A zero time indicates no snapshot exists and
+// one is due immediately. False is returned if the schedule has no further occurrences.
+func (s snapper) due(entry SnapEntry, template *nameTemplate, listing []zed.SnapshotListing) (time.Time, bool, error) {
+	if entry.Schedule != "" && entry.Interval != "" {
+		return time.Time{}, false, fmt.Errorf("both an interval and a schedule are set for '%s'", entry.Prefix)
+	}
+
+	var last time.Time
 	for _, v := range listing {
-		if strings.HasPrefix(v.Snapshot.Addr.Name, token) {
-			if v.Created.After(time.Now().Add(-interval)) {
-				return false
-			}
+		if template.matches(v.Snapshot.Addr.Name) && v.Created.After(last) {
+			last = v.Created
+		}
+	}
+
+	if entry.Schedule != "" {
+		schedule, err := parseSchedule(entry.Schedule)
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("could not parse schedule '%s': %w", entry.Schedule, err)
 		}
+
+		if last.IsZero() {
+			return last, true, nil
+		}
+
+		next := schedule.next(last)
+		return next, !next.IsZero(), nil
+	}
+
+	interval, err := entry.IntervalDuration()
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("could not parse interval '%s': %w", entry.Interval, err)
+	}
+
+	if last.IsZero() {
+		return last, true, nil
 	}
-	return true
+	return last.Add(interval), true, nil
 }
@@ -32,7 +32,81 @@ func TestSnapperNext(t *testing.T) {
 	}
 
 	expected := zed.Snapshot{Addr: zed.Address{FileSystem: fs, Name: "primary-00004"}}
-	actual := nextSnap(fs, "primary", snapshots)
+	template, err := parseTemplate(DefaultTemplate, "primary")
+	assert.NoError(t, err)
+	actual := nextSnap(fs, template, snapshots, latest)
 
 	assert.Equal(t, expected, actual)
 }
+
+func TestSnapperExpiredSchedule(t *testing.T) {
+	fs := zed.FileSystem{Pool: "pool-0", Name: "test"}
+	last := time.Date(2021, time.October, 6, 0, 2, 0, 0, time.Local)
+
+	snapshots := []zed.SnapshotListing{
+		{
+			Snapshot: zed.Snapshot{Addr: zed.Address{FileSystem: fs, Name: "daily-00003"}},
+			Created:  last,
+		},
+	}
+
+	entry := SnapEntry{Prefix: "daily", Schedule: "*-*-* 00:00"}
+	template, err := entry.template()
+	assert.NoError(t, err)
+	s := snapper{}
+
+	expired, err := s.expired(entry, template, snapshots, time.Date(2021, time.October, 6, 23, 59, 0, 0, time.Local))
+	assert.NoError(t, err)
+	assert.False(t, expired)
+
+	expired, err = s.expired(entry, template, snapshots, time.Date(2021, time.October, 7, 0, 0, 0, 0, time.Local))
+	assert.NoError(t, err)
+	assert.True(t, expired)
+
+	expired, err = s.expired(SnapEntry{Prefix: "daily", Schedule: "daily"}, template, nil, last)
+	assert.NoError(t, err)
+	assert.True(t, expired)
+
+	_, err = s.expired(SnapEntry{Prefix: "daily", Schedule: "daily", Interval: "1h"}, template, snapshots, last)
+	assert.Error(t, err)
+}
+
+func TestSnapperDescendants(t *testing.T) {
+	root := zed.FileSystem{Pool: "pool-0", Name: "home"}
+	children := []zed.FileSystem{
+		root,
+		{Pool: "pool-0", Name: "home/alice"},
+		{Pool: "pool-0", Name: "home/bob"},
+		{Pool: "pool-0", Name: "home/bob/cache"},
+		{Pool: "pool-0", Name: "home/cache"},
+		{Pool: "pool-0", Name: "home/cache/build"},
+	}
+
+	snapshot := zed.Snapshot{Addr: zed.Address{FileSystem: root, Name: "daily-00001"}}
+	actual, err := descendants(snapshot, children, []string{"cache", "bob/cache"})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []zed.Snapshot{
+		{Addr: zed.Address{FileSystem: root, Name: "daily-00001"}},
+		{Addr: zed.Address{FileSystem: children[1], Name: "daily-00001"}},
+		{Addr: zed.Address{FileSystem: children[2], Name: "daily-00001"}},
+	}, actual)
+}
+
+func TestSnapperNextWithTemplate(t *testing.T) {
+	fs := zed.FileSystem{Pool: "pool-0", Name: "test"}
+	now := time.Date(2021, time.October, 6, 21, 11, 0, 0, time.Local)
+
+	snapshots := []zed.SnapshotListing{
+		{Snapshot: zed.Snapshot{Addr: zed.Address{FileSystem: fs, Name: "daily-2021-10-04_00:00-00007"}}},
+		{Snapshot: zed.Snapshot{Addr: zed.Address{FileSystem: fs, Name: "daily-2021-10-05_00:00-00008"}}},
+		{Snapshot: zed.Snapshot{Addr: zed.Address{FileSystem: fs, Name: "daily-00042"}}},
+		{Snapshot: zed.Snapshot{Addr: zed.Address{FileSystem: fs, Name: "daily-yesterday-00043"}}},
+	}
+
+	template, err := parseTemplate("{prefix}-{2006-01-02_15:04}-{seq}", "daily")
+	assert.NoError(t, err)
+
+	expected := zed.Snapshot{Addr: zed.Address{FileSystem: fs, Name: "daily-2021-10-06_21:11-00009"}}
+	assert.Equal(t, expected, nextSnap(fs, template, snapshots, now))
+}
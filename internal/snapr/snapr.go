@@ -2,6 +2,9 @@ package snapr
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"snapr/internal/stow"
 	"snapr/internal/zed"
 )
 
@@ -9,29 +12,143 @@ import (
 type Snapr struct {
 	ctx      context.Context
 	settings *Settings
-	zed      *zed.Zed
+	zed      zed.ZFS
+	stow     []stow.SetOption
+	plan     *plan
+	metrics  *metrics
+	budget   *budget
+}
+
+// Option allows overriding of defaults when instantiating Snapr.
+type Option func(*Snapr) error
+
+// WithZFS performs ZFS operations using the given implementation rather than the 'zfs' command.
+func WithZFS(z zed.ZFS) Option {
+	return func(s *Snapr) error {
+		s.zed = z
+		return nil
+	}
+}
+
+// WithForwarder performs requests to storage providers using the forwarder.
+func WithForwarder(forwarder stow.Forwarder) Option {
+	return func(s *Snapr) error {
+		s.stow = append(s.stow, func(settings *stow.Settings) error {
+			settings.Forwarder = forwarder
+			return nil
+		})
+		return nil
+	}
+}
+
+// WithDryRun writes the operations which would be performed to the writer instead of performing them.
+func WithDryRun(out io.Writer) Option {
+	return func(s *Snapr) error {
+		s.plan = &plan{out: out}
+		return nil
+	}
 }
 
 // New instantiates a new instance of Snapr.
-func New(ctx context.Context, settings *Settings) (*Snapr, error) {
-	zed, err := zed.New()
-	if err != nil {
-		return nil, err
+func New(ctx context.Context, settings *Settings, options ...Option) (*Snapr, error) {
+	s := &Snapr{
+		ctx:      ctx,
+		settings: settings,
+		metrics:  newMetrics(settings.Metrics),
+		budget:   newBudget(settings),
+	}
+
+	for _, option := range options {
+		if err := option(s); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.zed == nil {
+		zed, err := zed.New()
+		if err != nil {
+			return nil, err
+		}
+		s.zed = zed
 	}
-	return &Snapr{ctx, settings, zed}, nil
+	return s, nil
 }
 
-// Snap creates snapshots according to the settings.
-func (s *Snapr) Snap() {
-	s.newSnapper().Snap()
+// Snap creates snapshots according to the settings. A result is reported for each snapshot created or which failed.
+func (s *Snapr) Snap() Report {
+	report := Report{Operation: "snap", Results: s.newSnapper().Snap()}
+	s.writeMetrics()
+	s.notify(report)
+	return report
 }
 
-// Send uploads a full or incremental stream based on the settings.
-func (s *Snapr) Send() {
-	s.newSender().Send()
+// Send uploads a full or incremental stream based on the settings. A result is reported for each destination.
+func (s *Snapr) Send() Report {
+	report := Report{Operation: "send", Results: s.newSender().Send()}
+	s.writeMetrics()
+	s.notify(report)
+	return report
+}
+
+func (s *Snapr) writeMetrics() {
+	if s.plan != nil {
+		return
+	}
+
+	if err := s.metrics.write(); err != nil {
+		Logger.Warn().Msgf("failed to write metrics to '%s': %s", s.settings.Metrics, err)
+	}
+}
+
+func (s *Snapr) notify(report Report) {
+	if s.plan != nil {
+		return
+	}
+
+	if err := s.settings.Notify.notify(report); err != nil {
+		Logger.Warn().Msgf("notification failed: %s", err)
+	}
+}
+
+// Prune destroys snapshots which have expired according to the settings. A result is reported for each snapshot destroyed
+// or which failed.
+func (s *Snapr) Prune() Report {
+	report := Report{Operation: "prune", Results: s.newPruner().Prune()}
+	s.writeMetrics()
+	s.notify(report)
+	return report
 }
 
 // Restore restores a file system from a bucket.
 func (s *Snapr) Restore(fileSystem string) error {
-	return s.newRestorer().restore(fileSystem)
+	return s.RestoreWith(fileSystem, RestoreOptions{Archive: -1})
+}
+
+// RestoreWith restores a file system from a bucket into a target up to a snapshot or archive.
+func (s *Snapr) RestoreWith(fileSystem string, options RestoreOptions) error {
+	return s.newRestorer().restore(fileSystem, options)
+}
+
+// State retrieves the replication state recorded for each destination of a file system. The states are ordered as the
+// destinations in the settings and are nil where nothing has been sent.
+func (s *Snapr) State(fileSystem string) ([]*ReplicationState, error) {
+	settings, ok := s.settings.FileSystems[fileSystem]
+	if !ok {
+		return nil, fmt.Errorf("no settings for '%s'", fileSystem)
+	}
+
+	fs, err := zed.ToFileSystem(fileSystem)
+	if err != nil {
+		return nil, err
+	}
+
+	states := make([]*ReplicationState, 0, len(settings.Send))
+	for _, entry := range settings.Send {
+		state, err := readState(s.ctx, s.zed, *fs, entry)
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, state)
+	}
+	return states, nil
 }
@@ -0,0 +1,451 @@
+package snapr
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"snapr/internal/stow/stowtest"
+	"snapr/internal/zed"
+	"snapr/internal/zed/zedtest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testEndpoint = "s3.test.example.com"
+
+// testClock provides creation times which advance by a day with each snapshot.
+func testClock(fake *zedtest.Fake) {
+	now := time.Date(2021, time.October, 1, 0, 0, 0, 0, time.UTC)
+	fake.Clock = func() time.Time {
+		now = now.Add(24 * time.Hour)
+		return now
+	}
+}
+
+func testSettings(fs string) *Settings {
+	settings := NewSettings()
+	settings.Threads = 2
+	settings.PartSize = 1
+	settings.VolumeSize = 2
+	settings.FileSystems = map[string]FileSystemSettings{
+		fs: {
+			Snap: []SnapEntry{
+				{Interval: "1h", Prefix: "daily", Hold: []string{"test"}},
+			},
+			Send: []SendEntry{
+				{
+					Endpoint: testEndpoint,
+					Region:   "test",
+					Account:  "account",
+					Secret:   "secret",
+					Bucket:   "bucket",
+					Release:  []string{"test"},
+				},
+			},
+		},
+	}
+	return settings
+}
+
+func testSnapr(t *testing.T, fake *zedtest.Fake, provider *stowtest.Provider, settings *Settings) *Snapr {
+	s, err := New(context.Background(), settings, WithZFS(fake), WithForwarder(provider.Forward))
+	require.NoError(t, err)
+	return s
+}
+
+func testData(seed byte, size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = seed + byte(i%251)
+	}
+	return data
+}
+
+func TestSnapSendRestore(t *testing.T) {
+	fs := zed.FileSystem{Pool: "pool-0", Name: "test"}
+	ctx := context.Background()
+
+	local := zedtest.New()
+	testClock(local)
+	require.NoError(t, local.CreateFileSystem(fs))
+
+	provider := stowtest.New(testEndpoint)
+	s := testSnapr(t, local, provider, testSettings(fs.String()))
+
+	// A full stream spanning several parts and volumes.
+	require.NoError(t, local.Write(fs, testData(1, 3*Megabyte)))
+	s.Snap()
+	s.Send()
+
+	keys := provider.Keys("bucket")
+	assert.Contains(t, keys, "pool-0/test/00000/contents")
+	assert.Contains(t, keys, "pool-0/test/00000/00000")
+	assert.Contains(t, keys, "pool-0/test/00000/00001")
+	assert.Equal(t, 0, provider.Uploads())
+
+	// An incremental stream releases the hold from the previous target.
+	require.NoError(t, local.Write(fs, testData(2, Megabyte)))
+	s.Snap()
+	s.Send()
+
+	assert.Contains(t, provider.Keys("bucket"), "pool-0/test/00001/contents")
+	listing, err := local.ListSnapshots(ctx, fs)
+	require.NoError(t, err)
+	require.Len(t, listing, 2)
+	assert.Empty(t, listing[0].Holds)
+	assert.Equal(t, []string{"test"}, listing[1].Holds)
+
+	// Once the archived snapshot has been destroyed its bookmark is used as the source.
+	require.NoError(t, local.Write(fs, testData(3, Megabyte/2)))
+	s.Snap()
+	require.NoError(t, local.ReleaseSnapshot(ctx, listing[1].Snapshot, "test"))
+	require.NoError(t, local.Destroy(ctx, listing[1].Snapshot))
+	s.Send()
+
+	assert.Contains(t, provider.Keys("bucket"), "pool-0/test/00002/contents")
+
+	// Restore on another host.
+	remote := zedtest.New()
+	r := testSnapr(t, remote, provider, testSettings(fs.String()))
+	require.NoError(t, r.Restore(fs.String()))
+
+	restored, err := remote.Read(fs)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(testData(3, Megabyte/2), restored))
+
+	received, err := remote.ListSnapshots(ctx, fs)
+	require.NoError(t, err)
+	names := make([]string, 0)
+	for _, v := range received {
+		names = append(names, v.Snapshot.Addr.Name)
+	}
+	assert.Equal(t, []string{"daily-00000", "daily-00001", "daily-00002"}, names)
+
+	// Restoring again finds every archive present locally.
+	require.NoError(t, r.Restore(fs.String()))
+	again, err := remote.ListSnapshots(ctx, fs)
+	require.NoError(t, err)
+	assert.Len(t, again, 3)
+
+	// A restore will not overwrite an unrelated file system.
+	unrelated := zedtest.New()
+	require.NoError(t, unrelated.CreateFileSystem(fs))
+	require.NoError(t, unrelated.CreateSnapshot(ctx, zed.Snapshot{Addr: zed.Address{FileSystem: fs, Name: "other"}}))
+	u := testSnapr(t, unrelated, provider, testSettings(fs.String()))
+	assert.Error(t, u.Restore(fs.String()))
+}
+
+func TestSendUpToDate(t *testing.T) {
+	fs := zed.FileSystem{Pool: "pool-0", Name: "test"}
+
+	local := zedtest.New()
+	testClock(local)
+	require.NoError(t, local.CreateFileSystem(fs))
+	require.NoError(t, local.Write(fs, testData(1, 100)))
+
+	provider := stowtest.New(testEndpoint)
+	s := testSnapr(t, local, provider, testSettings(fs.String()))
+
+	s.Snap()
+	s.Send()
+	s.Send()
+
+	assert.Equal(t, []string{"pool-0/test/00000/00000", "pool-0/test/00000/contents"}, provider.Keys("bucket"))
+}
+
+func TestPrune(t *testing.T) {
+	fs := zed.FileSystem{Pool: "pool-0", Name: "test"}
+	ctx := context.Background()
+
+	local := zedtest.New()
+	testClock(local)
+	require.NoError(t, local.CreateFileSystem(fs))
+
+	settings := testSettings(fs.String())
+	entries := settings.FileSystems[fs.String()]
+	entries.Snap[0].Hold = nil
+	entries.Snap[0].Retain = Retention{Last: 1}
+	settings.FileSystems[fs.String()] = entries
+
+	provider := stowtest.New(testEndpoint)
+	s := testSnapr(t, local, provider, settings)
+
+	for i := 0; i < 4; i++ {
+		require.NoError(t, local.Write(fs, testData(byte(i), 100)))
+		s.Snap()
+		if i == 1 {
+			s.Send()
+		}
+	}
+
+	report := s.Prune()
+	require.NoError(t, report.Err())
+	assert.Equal(t, []Result{
+		{FileSystem: fs.String(), Detail: "destroyed pool-0/test@daily-00000"},
+		{FileSystem: fs.String(), Detail: "destroyed pool-0/test@daily-00002"},
+	}, report.Results)
+
+	listing, err := local.ListSnapshots(ctx, fs)
+	require.NoError(t, err)
+
+	names := make([]string, 0)
+	for _, v := range listing {
+		names = append(names, v.Snapshot.Addr.Name)
+	}
+	assert.Equal(t, []string{"daily-00001", "daily-00003"}, names, "the newest archived snapshot is retained")
+
+	// A file system which can't be pruned is reported as a failure.
+	settings.FileSystems["pool-0/missing"] = entries
+	report = testSnapr(t, local, provider, settings).Prune()
+	assert.Equal(t, "prune", report.Operation)
+	require.Len(t, report.Failures(), 1)
+	assert.Equal(t, "pool-0/missing", report.Failures()[0].FileSystem)
+	assert.True(t, report.Failed())
+}
+
+func TestSendBookmark(t *testing.T) {
+	fs := zed.FileSystem{Pool: "pool-0", Name: "test"}
+	ctx := context.Background()
+
+	local := zedtest.New()
+	testClock(local)
+	require.NoError(t, local.CreateFileSystem(fs))
+
+	provider := stowtest.New(testEndpoint)
+	s := testSnapr(t, local, provider, testSettings(fs.String()))
+
+	require.NoError(t, local.Write(fs, testData(1, 100)))
+	s.Snap()
+	require.False(t, s.Send().Failed())
+
+	require.NoError(t, local.Write(fs, testData(2, 100)))
+	s.Snap()
+	require.NoError(t, local.Write(fs, testData(3, 100)))
+	s.Snap()
+
+	listing, err := local.ListSnapshots(ctx, fs)
+	require.NoError(t, err)
+	require.Len(t, listing, 3)
+	require.NoError(t, local.ReleaseSnapshot(ctx, listing[0].Snapshot, "test"))
+	require.NoError(t, local.Destroy(ctx, listing[0].Snapshot))
+
+	// A stream from the bookmark contains only its target so it ends at the next snapshot and later snapshots keep their
+	// holds.
+	require.False(t, s.Send().Failed())
+
+	raw, ok := provider.Object("bucket", "pool-0/test/00001/contents")
+	require.True(t, ok)
+	var entries []ArchiveEntry
+	require.NoError(t, json.Unmarshal(raw, &entries))
+	require.Len(t, entries, 1)
+	assert.Equal(t, "daily-00001", entries[0].Name)
+
+	listing, err = local.ListSnapshots(ctx, fs)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"test"}, listing[0].Holds)
+	assert.Equal(t, []string{"test"}, listing[1].Holds)
+
+	require.False(t, s.Send().Failed())
+
+	raw, ok = provider.Object("bucket", "pool-0/test/00002/contents")
+	require.True(t, ok)
+	entries = nil
+	require.NoError(t, json.Unmarshal(raw, &entries))
+	require.Len(t, entries, 2)
+	assert.Equal(t, "daily-00002", entries[1].Name)
+
+	remote := zedtest.New()
+	require.NoError(t, testSnapr(t, remote, provider, testSettings(fs.String())).Restore(fs.String()))
+	restored, err := remote.ListSnapshots(ctx, fs)
+	require.NoError(t, err)
+	assert.Len(t, restored, 3)
+
+	// A file system with descendants can't be sent from a bookmark.
+	child := zed.FileSystem{Pool: "pool-0", Name: "test/child"}
+	require.NoError(t, local.CreateFileSystem(child))
+	require.NoError(t, local.Write(fs, testData(4, 100)))
+	s.Snap()
+
+	listing, err = local.ListSnapshots(ctx, fs)
+	require.NoError(t, err)
+	require.NoError(t, local.ReleaseSnapshot(ctx, listing[1].Snapshot, "test"))
+	require.NoError(t, local.Destroy(ctx, listing[1].Snapshot))
+
+	assert.True(t, s.Send().Failed())
+	assert.NotContains(t, provider.Keys("bucket"), "pool-0/test/00003/contents")
+}
+
+func TestSendState(t *testing.T) {
+	fs := zed.FileSystem{Pool: "pool-0", Name: "test"}
+
+	local := zedtest.New()
+	testClock(local)
+	require.NoError(t, local.CreateFileSystem(fs))
+
+	provider := stowtest.New(testEndpoint)
+	s := testSnapr(t, local, provider, testSettings(fs.String()))
+
+	require.NoError(t, local.Write(fs, testData(1, 100)))
+	s.Snap()
+	s.Send()
+
+	states, err := s.State(fs.String())
+	require.NoError(t, err)
+	require.Len(t, states, 1)
+	require.NotNil(t, states[0])
+	assert.Equal(t, 0, states[0].Archive)
+	assert.Equal(t, "daily-00000", states[0].Snapshot)
+	assert.Greater(t, states[0].Bytes, 100)
+
+	// The recorded state is used instead of retrieving the contents of the previous archive.
+	provider.Fail = func(req *http.Request) error {
+		if req.Method == http.MethodGet && strings.HasSuffix(req.URL.Path, "/contents") {
+			return errors.New("contents retrieved")
+		}
+		return nil
+	}
+
+	require.NoError(t, local.Write(fs, testData(2, 100)))
+	s.Snap()
+	s.Send()
+
+	states, err = s.State(fs.String())
+	require.NoError(t, err)
+	assert.Equal(t, 1, states[0].Archive)
+	assert.Equal(t, "daily-00001", states[0].Snapshot)
+
+	// An archive removed from the bucket is detected before sending.
+	provider.Delete("bucket", "pool-0/test/00001/00000")
+	provider.Delete("bucket", "pool-0/test/00001/contents")
+
+	require.NoError(t, local.Write(fs, testData(3, 100)))
+	s.Snap()
+	s.Send()
+
+	assert.NotContains(t, provider.Keys("bucket"), "pool-0/test/00001/contents")
+	states, err = s.State(fs.String())
+	require.NoError(t, err)
+	assert.Equal(t, 1, states[0].Archive)
+}
+
+func TestSendStaleState(t *testing.T) {
+	fs := zed.FileSystem{Pool: "pool-0", Name: "test"}
+	ctx := context.Background()
+
+	local := zedtest.New()
+	testClock(local)
+	require.NoError(t, local.CreateFileSystem(fs))
+
+	provider := stowtest.New(testEndpoint)
+	settings := testSettings(fs.String())
+	s := testSnapr(t, local, provider, settings)
+	property := settings.FileSystems[fs.String()].Send[0].Inherit(settings).stateProperty()
+
+	require.NoError(t, local.Write(fs, testData(1, 100)))
+	s.Snap()
+	require.False(t, s.Send().Failed())
+
+	stale, err := local.GetProperty(ctx, fs, stateDomain, property)
+	require.NoError(t, err)
+
+	// The state lags the bucket if it couldn't be recorded after a send.
+	require.NoError(t, local.Write(fs, testData(2, 100)))
+	s.Snap()
+	require.False(t, s.Send().Failed())
+	require.NoError(t, local.SetProperty(ctx, fs, stateDomain, property, stale))
+
+	require.NoError(t, local.Write(fs, testData(3, 100)))
+	s.Snap()
+	require.False(t, s.Send().Failed())
+	assert.Contains(t, provider.Keys("bucket"), "pool-0/test/00002/contents")
+
+	states, err := s.State(fs.String())
+	require.NoError(t, err)
+	assert.Equal(t, 2, states[0].Archive)
+	assert.Equal(t, "daily-00002", states[0].Snapshot)
+
+	// A missing state is recovered from the bucket.
+	require.NoError(t, local.SetProperty(ctx, fs, stateDomain, property, ""))
+
+	require.NoError(t, local.Write(fs, testData(4, 100)))
+	s.Snap()
+	require.False(t, s.Send().Failed())
+	assert.Contains(t, provider.Keys("bucket"), "pool-0/test/00003/contents")
+
+	// A lagging state whose archive holds a different snapshot has diverged.
+	var state ReplicationState
+	require.NoError(t, json.Unmarshal([]byte(stale), &state))
+	state.Identity = "1"
+	value, err := json.Marshal(state)
+	require.NoError(t, err)
+	require.NoError(t, local.SetProperty(ctx, fs, stateDomain, property, string(value)))
+
+	require.NoError(t, local.Write(fs, testData(5, 100)))
+	s.Snap()
+	assert.True(t, s.Send().Failed())
+	assert.NotContains(t, provider.Keys("bucket"), "pool-0/test/00004/contents")
+}
+
+func TestDryRun(t *testing.T) {
+	fs := zed.FileSystem{Pool: "pool-0", Name: "test"}
+	ctx := context.Background()
+
+	local := zedtest.New()
+	testClock(local)
+	require.NoError(t, local.CreateFileSystem(fs))
+	require.NoError(t, local.Write(fs, testData(1, 100)))
+
+	provider := stowtest.New(testEndpoint)
+	settings := testSettings(fs.String())
+
+	var out bytes.Buffer
+	dry, err := New(ctx, settings, WithZFS(local), WithForwarder(provider.Forward), WithDryRun(&out))
+	require.NoError(t, err)
+
+	// Snapshots are planned but not created.
+	dry.Snap()
+	assert.Equal(t, "snapshot pool-0/test@daily-00000\n  hold 'test' on pool-0/test@daily-00000\n", out.String())
+
+	listing, err := local.ListSnapshots(ctx, fs)
+	require.NoError(t, err)
+	assert.Empty(t, listing)
+
+	s := testSnapr(t, local, provider, settings)
+	s.Snap()
+	s.Send()
+	require.NoError(t, local.Write(fs, testData(2, 100)))
+	s.Snap()
+
+	// An incremental send is planned with its keys and the holds it would release.
+	keys := provider.Keys("bucket")
+	out.Reset()
+	dry.Send()
+
+	plan := out.String()
+	assert.Contains(t, plan, "send incremental pool-0/test@daily-00000 -> pool-0/test@daily-00001 to bucket\n")
+	assert.Contains(t, plan, "  estimated size ")
+	assert.Contains(t, plan, "  upload pool-0/test/00001/00000\n  upload pool-0/test/00001/contents\n")
+	assert.Contains(t, plan, "  release 'test' on pool-0/test@daily-00000\n")
+	assert.Contains(t, plan, "  bookmark pool-0/test#daily-00001\n")
+	assert.Equal(t, keys, provider.Keys("bucket"))
+
+	listing, err = local.ListSnapshots(ctx, fs)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"test"}, listing[0].Holds)
+
+	// A restore is planned without receiving anything.
+	remote := zedtest.New()
+	out.Reset()
+	restore, err := New(ctx, settings, WithZFS(remote), WithForwarder(provider.Forward), WithDryRun(&out))
+	require.NoError(t, err)
+	require.NoError(t, restore.Restore(fs.String()))
+
+	assert.Equal(t, "receive archive 0 of pool-0/test from bucket into pool-0/test\n  download pool-0/test/00000/00000\n  snapshot pool-0/test@daily-00000\n", out.String())
+	assert.False(t, remote.Exists(fs))
+}
@@ -0,0 +1,57 @@
+package snapr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"snapr/internal/zed"
+	"strings"
+	"time"
+)
+
+// stateDomain is the namespace of the user properties snapr sets on file systems.
+const stateDomain = "snapr"
+
+var invalidProperty = regexp.MustCompile(`[^a-z0-9:._-]`)
+
+// ReplicationState records the last successful send of a file system to a destination. It is stored as a user property
+// on the file system (e.g. 'snapr:s3.example.com:bucket').
+type ReplicationState struct {
+	Archive  int       `json:"archive"`
+	Snapshot string    `json:"snapshot"`
+	Identity string    `json:"identity"`
+	Time     time.Time `json:"time"`
+	Bytes    int       `json:"bytes"`
+}
+
+// stateProperty names the user property holding the replication state for the destination.
+func (e SendEntry) stateProperty() string {
+	return invalidProperty.ReplaceAllString(strings.ToLower(e.Endpoint+":"+e.Bucket), "_")
+}
+
+// readState retrieves the replication state for the destination or nil if nothing has been recorded.
+func readState(ctx context.Context, z zed.ZFS, fs zed.FileSystem, entry SendEntry) (*ReplicationState, error) {
+	value, err := z.GetProperty(ctx, fs, stateDomain, entry.stateProperty())
+	if err != nil {
+		return nil, err
+	}
+
+	if value == "" || value == "-" {
+		return nil, nil
+	}
+
+	var state ReplicationState
+	if err := json.Unmarshal([]byte(value), &state); err != nil {
+		return nil, fmt.Errorf("could not parse state '%s:%s' (%w)", stateDomain, entry.stateProperty(), err)
+	}
+	return &state, nil
+}
+
+func writeState(ctx context.Context, z zed.ZFS, fs zed.FileSystem, entry SendEntry, state ReplicationState) error {
+	value, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return z.SetProperty(ctx, fs, stateDomain, entry.stateProperty(), string(value))
+}
@@ -0,0 +1,156 @@
+package snapr
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"snapr/internal/stow"
+	"snapr/internal/zed"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Status describes how far a destination lags behind its file system.
+type Status struct {
+	FileSystem string            `json:"fileSystem"`
+	Endpoint   string            `json:"endpoint"`
+	Bucket     string            `json:"bucket"`
+	Archived   string            `json:"archived,omitempty"`
+	Created    *time.Time        `json:"created,omitempty"`
+	Age        int64             `json:"age,omitempty"` // seconds since the archived snapshot was created
+	Unsent     int               `json:"unsent"`
+	Chain      int               `json:"chain"`
+	Missing    []string          `json:"missing,omitempty"`
+	State      *ReplicationState `json:"state,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// Status compares the snapshots of each configured file system with the archives at each destination.
+func (s *Snapr) Status() []Status {
+	targets := make([]string, 0, len(s.settings.FileSystems))
+	for target := range s.settings.FileSystems {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+
+	statuses := make([]Status, 0)
+	for _, target := range targets {
+		for _, entry := range s.settings.FileSystems[target].Send {
+			statuses = append(statuses, s.status(target, entry.Inherit(s.settings)))
+		}
+	}
+	return statuses
+}
+
+func (s *Snapr) status(target string, entry SendEntry) Status {
+	status := Status{
+		FileSystem: target,
+		Endpoint:   entry.Endpoint,
+		Bucket:     entry.Bucket,
+		Missing:    make([]string, 0),
+	}
+
+	fail := func(err error) Status {
+		status.Error = err.Error()
+		return status
+	}
+
+	fs, err := zed.ToFileSystem(target)
+	if err != nil {
+		return fail(err)
+	}
+
+	listing, err := s.zed.ListSnapshots(s.ctx, *fs)
+	if err != nil {
+		return fail(fmt.Errorf("failed to list snapshots (%w)", err))
+	}
+
+	state, err := readState(s.ctx, s.zed, *fs, entry)
+	if err != nil {
+		return fail(err)
+	}
+	status.State = state
+
+	remote, err := newRemote(s.ctx, s.zed, entry, nil, s.stow...)
+	if err != nil {
+		return fail(err)
+	}
+
+	status.Chain = remote.catalogue.length(target)
+	status.Missing = remote.catalogue.missing(target)
+	if status.Chain == 0 {
+		status.Unsent = len(listing)
+		return status
+	}
+
+	entries, err := remote.contents(*fs, status.Chain-1)
+	if err != nil {
+		var statusError *stow.StatusError
+		if errors.As(err, &statusError) && statusError.StatusCode == http.StatusNotFound {
+			status.Missing = append(status.Missing, fmt.Sprintf("contents of archive %d", status.Chain-1))
+		}
+		return fail(err)
+	}
+
+	if len(entries) == 0 {
+		return fail(fmt.Errorf("no contents retained in archive %d", status.Chain-1))
+	}
+
+	last := entries[len(entries)-1]
+	status.Archived = last.Name
+	status.Created = &last.Created
+	status.Age = int64(time.Since(last.Created).Seconds())
+	status.Unsent = unsent(listing, last)
+	return status
+}
+
+// unsent counts the snapshots newer than the archived snapshot. If the archived snapshot no longer exists locally the
+// creation times are compared.
+func unsent(listing []zed.SnapshotListing, archived ArchiveEntry) int {
+	for i, v := range listing {
+		if v.Identity == archived.Identity {
+			return len(listing) - i - 1
+		}
+	}
+
+	count := 0
+	for _, v := range listing {
+		if v.Created.After(archived.Created) {
+			count++
+		}
+	}
+	return count
+}
+
+// WriteStatus writes the statuses as either a 'table' or 'json'.
+func WriteStatus(w io.Writer, statuses []Status, format string) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(statuses)
+	case "table", "":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "FILE SYSTEM\tBUCKET\tARCHIVED\tAGE\tUNSENT\tCHAIN\tPROBLEMS")
+		for _, v := range statuses {
+			archived, age := "-", "-"
+			if v.Archived != "" {
+				archived = v.Archived
+				age = (time.Duration(v.Age) * time.Second).Truncate(time.Minute).String()
+			}
+
+			problems := append([]string{}, v.Missing...)
+			if v.Error != "" {
+				problems = append(problems, v.Error)
+			}
+
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\t%s\n", v.FileSystem, v.Bucket, archived, age, v.Unsent, v.Chain, strings.Join(problems, "; "))
+		}
+		return tw.Flush()
+	}
+	return fmt.Errorf("unsupported format '%s'", format)
+}
@@ -0,0 +1,83 @@
+package snapr
+
+import (
+	"bytes"
+	"encoding/json"
+	"snapr/internal/stow/stowtest"
+	"snapr/internal/zed"
+	"snapr/internal/zed/zedtest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatus(t *testing.T) {
+	fs := zed.FileSystem{Pool: "pool-0", Name: "test"}
+
+	local := zedtest.New()
+	testClock(local)
+	require.NoError(t, local.CreateFileSystem(fs))
+
+	provider := stowtest.New(testEndpoint)
+	s := testSnapr(t, local, provider, testSettings(fs.String()))
+
+	statuses := s.Status()
+	require.Len(t, statuses, 1)
+	assert.Equal(t, 0, statuses[0].Chain)
+	assert.Empty(t, statuses[0].Archived)
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, local.Write(fs, testData(byte(i), 100)))
+		s.Snap()
+		if i < 2 {
+			s.Send()
+		}
+	}
+
+	statuses = s.Status()
+	require.Len(t, statuses, 1)
+	status := statuses[0]
+	assert.Equal(t, "pool-0/test", status.FileSystem)
+	assert.Equal(t, "bucket", status.Bucket)
+	assert.Equal(t, "daily-00001", status.Archived)
+	assert.Equal(t, 1, status.Unsent)
+	assert.Equal(t, 2, status.Chain)
+	assert.Empty(t, status.Missing)
+	assert.Empty(t, status.Error)
+	require.NotNil(t, status.State)
+	assert.Equal(t, 1, status.State.Archive)
+
+	provider.Delete("bucket", "pool-0/test/00000/00000")
+	provider.Delete("bucket", "pool-0/test/00001/contents")
+
+	status = s.Status()[0]
+	assert.Equal(t, []string{"archive 0", "contents of archive 1"}, status.Missing)
+	assert.NotEmpty(t, status.Error)
+}
+
+func TestWriteStatus(t *testing.T) {
+	created := time.Now().Add(-90 * time.Minute)
+	statuses := []Status{
+		{FileSystem: "pool-0/test", Bucket: "bucket", Archived: "daily-00001", Created: &created, Age: 5400, Unsent: 2, Chain: 3},
+		{FileSystem: "pool-0/other", Bucket: "bucket", Chain: 2, Missing: []string{"archive 0"}, Error: "failed"},
+	}
+
+	var table bytes.Buffer
+	require.NoError(t, WriteStatus(&table, statuses, "table"))
+	lines := strings.Split(strings.TrimSpace(table.String()), "\n")
+	require.Len(t, lines, 3)
+	assert.Equal(t, []string{"pool-0/test", "bucket", "daily-00001", "1h30m0s", "2", "3"}, strings.Fields(lines[1]))
+	assert.True(t, strings.HasSuffix(lines[2], "archive 0; failed"))
+
+	var out bytes.Buffer
+	require.NoError(t, WriteStatus(&out, statuses, "json"))
+	var decoded []map[string]interface{}
+	require.NoError(t, json.Unmarshal(out.Bytes(), &decoded))
+	assert.Equal(t, float64(5400), decoded[0]["age"])
+	assert.Equal(t, float64(2), decoded[0]["unsent"])
+
+	assert.Error(t, WriteStatus(&out, statuses, "xml"))
+}
@@ -0,0 +1,141 @@
+package snapr
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// errStalled indicates a branch of a tee fell too far behind the others.
+var errStalled = errors.New("destination stalled")
+
+// tee copies a stream to several branches. A branch which fails or stalls is detached without affecting the others.
+type tee struct {
+	src      *io.PipeReader
+	branches []*branch
+	stall    time.Duration
+}
+
+type branch struct {
+	out      *io.PipeReader
+	in       *io.PipeWriter
+	detached bool
+}
+
+// newTee creates a tee with the given number of branches. A branch is detached if it hasn't accepted data within the
+// stall duration of another branch accepting it.
+func newTee(src *io.PipeReader, branches int, stall time.Duration) *tee {
+	t := &tee{
+		src:      src,
+		branches: make([]*branch, 0, branches),
+		stall:    stall,
+	}
+
+	for i := 0; i < branches; i++ {
+		out, in := io.Pipe()
+		t.branches = append(t.branches, &branch{out: out, in: in})
+	}
+	return t
+}
+
+// reader returns the reader of a branch. A reader should be closed with an error if it stops reading early.
+func (t *tee) reader(index int) *io.PipeReader {
+	return t.branches[index].out
+}
+
+// run copies the source to each branch until the source is exhausted or every branch is detached.
+func (t *tee) run() error {
+	buf := make([]byte, Megabyte)
+
+	for {
+		n, err := t.src.Read(buf)
+		if n > 0 {
+			if !t.write(buf[:n]) {
+				t.src.CloseWithError(errStalled)
+				return errStalled
+			}
+		}
+
+		if err == io.EOF {
+			for _, b := range t.branches {
+				b.in.Close()
+			}
+			return nil
+		}
+
+		if err != nil {
+			for _, b := range t.branches {
+				b.in.CloseWithError(err)
+			}
+			return err
+		}
+	}
+}
+
+// write passes the data to every attached branch. False is returned once every branch is detached.
+func (t *tee) write(data []byte) bool {
+	done := make(chan int, len(t.branches))
+	errs := make([]error, len(t.branches))
+
+	var wg sync.WaitGroup
+	pending := 0
+	for i, b := range t.branches {
+		if b.detached {
+			continue
+		}
+
+		pending++
+		wg.Add(1)
+		go func(i int, b *branch) {
+			defer wg.Done()
+			_, errs[i] = b.in.Write(data)
+			done <- i
+		}(i, b)
+	}
+
+	if pending == 0 {
+		return false
+	}
+
+	// Waiting is unbounded until a branch accepts the data after which the others must keep up.
+	returned := make([]bool, len(t.branches))
+	var timeout <-chan time.Time
+
+	for pending > 0 {
+		select {
+		case i := <-done:
+			returned[i] = true
+			pending--
+
+			if errs[i] == nil && timeout == nil {
+				timer := time.NewTimer(t.stall)
+				defer timer.Stop()
+				timeout = timer.C
+			}
+		case <-timeout:
+			for i, b := range t.branches {
+				if !b.detached && !returned[i] {
+					b.in.CloseWithError(errStalled)
+				}
+			}
+			pending = 0
+		}
+	}
+	wg.Wait()
+
+	attached := false
+	for i, b := range t.branches {
+		if b.detached {
+			continue
+		}
+
+		if errs[i] != nil {
+			b.detached = true
+			b.in.CloseWithError(errs[i])
+			continue
+		}
+		attached = true
+	}
+	return attached
+}
@@ -0,0 +1,202 @@
+package snapr
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"snapr/internal/stow"
+	"snapr/internal/stow/stowtest"
+	"snapr/internal/zed"
+	"snapr/internal/zed/zedtest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTee(t *testing.T) {
+	data := testData(1, 3*Megabyte+1)
+
+	out, in := io.Pipe()
+	go func() {
+		in.Write(data)
+		in.Close()
+	}()
+
+	fanOut := newTee(out, 3, 50*time.Millisecond)
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+
+	// The first branch reads everything.
+	var received []byte
+	go func() {
+		defer wg.Done()
+		received, _ = ioutil.ReadAll(fanOut.reader(0))
+	}()
+
+	// The second branch fails early.
+	go func() {
+		defer wg.Done()
+		fanOut.reader(1).CloseWithError(assert.AnError)
+	}()
+
+	// The third branch stalls.
+	var stalled error
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, 10)
+		io.ReadFull(fanOut.reader(2), buf)
+		time.Sleep(200 * time.Millisecond)
+		_, stalled = ioutil.ReadAll(fanOut.reader(2))
+	}()
+
+	require.NoError(t, fanOut.run())
+	wg.Wait()
+
+	assert.True(t, bytes.Equal(data, received))
+	assert.Equal(t, errStalled, stalled)
+}
+
+// countingZFS counts the streams sent.
+type countingZFS struct {
+	*zedtest.Fake
+	mu    sync.Mutex
+	sends int
+}
+
+func (c *countingZFS) Send(ctx context.Context, source zed.Addressable, target zed.Snapshot, completion func(error) error) (*zed.Stream, error) {
+	c.mu.Lock()
+	c.sends++
+	c.mu.Unlock()
+	return c.Fake.Send(ctx, source, target, completion)
+}
+
+func TestSendShared(t *testing.T) {
+	fs := zed.FileSystem{Pool: "pool-0", Name: "test"}
+
+	local := &countingZFS{Fake: zedtest.New()}
+	testClock(local.Fake)
+	require.NoError(t, local.CreateFileSystem(fs))
+	require.NoError(t, local.Write(fs, testData(1, 100)))
+
+	settings := testSettings(fs.String())
+	entries := settings.FileSystems[fs.String()]
+	second := entries.Send[0]
+	second.Bucket = "second"
+	second.Release = []string{"second"}
+	entries.Send = append(entries.Send, second)
+	entries.Snap[0].Hold = []string{"test", "second"}
+	settings.FileSystems[fs.String()] = entries
+
+	provider := stowtest.New(testEndpoint)
+	s, err := New(context.Background(), settings, WithZFS(local), WithForwarder(provider.Forward))
+	require.NoError(t, err)
+
+	require.NoError(t, s.Snap().Err())
+	report := s.Send()
+	require.NoError(t, report.Err())
+	assert.Equal(t, 1, local.sends, "both destinations share a stream")
+	assert.Contains(t, provider.Keys("bucket"), "pool-0/test/00000/contents")
+	assert.Contains(t, provider.Keys("second"), "pool-0/test/00000/contents")
+
+	for _, entry := range entries.Send {
+		state, err := readState(context.Background(), local, fs, entry.Inherit(settings))
+		require.NoError(t, err)
+		require.NotNil(t, state)
+		assert.Equal(t, 0, state.Archive)
+	}
+
+	// A destination which fails is sent separately and doesn't affect the other.
+	provider.Fail = func(req *http.Request) error {
+		if req.Method == http.MethodPut && strings.HasPrefix(req.URL.Hostname(), "second.") && req.URL.Query().Get("uploadId") != "" {
+			return &stow.StatusError{StatusCode: http.StatusForbidden}
+		}
+		return nil
+	}
+
+	testClock(local.Fake)
+	require.NoError(t, local.CreateSnapshot(context.Background(), zed.Snapshot{Addr: zed.Address{FileSystem: fs, Name: "daily-00001"}}))
+	local.sends = 0
+
+	report = s.Send()
+	require.Len(t, report.Results, 2)
+	assert.NoError(t, report.Results[0].Err)
+	assert.Error(t, report.Results[1].Err)
+	assert.Equal(t, 2, local.sends, "the failed destination falls back to its own send")
+	assert.Contains(t, provider.Keys("bucket"), "pool-0/test/00001/contents")
+	assert.NotContains(t, provider.Keys("second"), "pool-0/test/00001/contents")
+	assert.Zero(t, provider.Uploads(), "failed uploads are aborted")
+}
+
+func TestSendSharedHoldsThreads(t *testing.T) {
+	fs := zed.FileSystem{Pool: "pool-0", Name: "test"}
+
+	local := &countingZFS{Fake: zedtest.New()}
+	testClock(local.Fake)
+	require.NoError(t, local.CreateFileSystem(fs))
+	require.NoError(t, local.Write(fs, testData(1, 3*Megabyte)))
+
+	settings := testSettings(fs.String())
+	entries := settings.FileSystems[fs.String()]
+	second := entries.Send[0]
+	second.Bucket = "second"
+	entries.Send = append(entries.Send, second)
+	settings.FileSystems[fs.String()] = entries
+
+	provider := stowtest.New(testEndpoint)
+	s, err := New(context.Background(), settings, WithZFS(local), WithForwarder(provider.Forward))
+	require.NoError(t, err)
+	require.NoError(t, s.Snap().Err())
+
+	// Another transfer holds a thread so the stream doesn't start until the threads of both destinations are free.
+	require.NoError(t, s.budget.hold(context.Background(), 1))
+
+	done := make(chan Report, 1)
+	go func() {
+		done <- s.Send()
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	local.mu.Lock()
+	assert.Zero(t, local.sends, "the stream waits for its threads")
+	local.mu.Unlock()
+
+	s.budget.unhold(1)
+	report := <-done
+	require.NoError(t, report.Err())
+	assert.Equal(t, 1, local.sends)
+}
+
+func TestSendSharedSameDestination(t *testing.T) {
+	fs := zed.FileSystem{Pool: "pool-0", Name: "test"}
+
+	local := &countingZFS{Fake: zedtest.New()}
+	testClock(local.Fake)
+	require.NoError(t, local.CreateFileSystem(fs))
+	require.NoError(t, local.Write(fs, testData(1, 100)))
+
+	settings := testSettings(fs.String())
+	entries := settings.FileSystems[fs.String()]
+	duplicate := entries.Send[0]
+	duplicate.Name = "duplicate"
+	entries.Send = append(entries.Send, duplicate)
+	settings.FileSystems[fs.String()] = entries
+
+	provider := stowtest.New(testEndpoint)
+	s, err := New(context.Background(), settings, WithZFS(local), WithForwarder(provider.Forward))
+	require.NoError(t, err)
+	require.NoError(t, s.Snap().Err())
+
+	// Entries writing to the same prefix don't share a stream so the second follows the first.
+	report := s.Send()
+	require.NoError(t, report.Err())
+	require.Len(t, report.Results, 2)
+	assert.Equal(t, errUpToDate.Error(), report.Results[1].Detail)
+	assert.Equal(t, 1, local.sends)
+}
@@ -0,0 +1,211 @@
+package snapr
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultTemplate names snapshots using the prefix and a sequence number (e.g. 'daily-00010').
+const DefaultTemplate = "{prefix}-{seq}"
+
+const (
+	literalToken = iota
+	prefixToken
+	sequenceToken
+	timeToken
+)
+
+type token struct {
+	kind int
+	text string
+}
+
+// nameTemplate generates and recognises snapshot names. Placeholders are '{prefix}', '{seq}', or a Go time layout (e.g. '{2006-01-02_15:04}').
+type nameTemplate struct {
+	prefix  string
+	tokens  []token
+	pattern *regexp.Regexp
+}
+
+// snapshotName holds the fields parsed from a snapshot name.
+type snapshotName struct {
+	sequence int
+}
+
+func (e SnapEntry) template() (*nameTemplate, error) {
+	if e.Template == "" {
+		return parseTemplate(DefaultTemplate, e.Prefix)
+	}
+	return parseTemplate(e.Template, e.Prefix)
+}
+
+func parseTemplate(text, prefix string) (*nameTemplate, error) {
+	t := &nameTemplate{prefix: prefix}
+
+	var expression strings.Builder
+	expression.WriteString("^")
+
+	named := false
+	for remaining := text; remaining != ""; {
+		start := strings.Index(remaining, "{")
+		if start < 0 {
+			t.tokens = append(t.tokens, token{literalToken, remaining})
+			expression.WriteString(regexp.QuoteMeta(remaining))
+			break
+		}
+
+		if start > 0 {
+			t.tokens = append(t.tokens, token{literalToken, remaining[:start]})
+			expression.WriteString(regexp.QuoteMeta(remaining[:start]))
+		}
+
+		end := strings.Index(remaining[start:], "}")
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated placeholder in template '%s'", text)
+		}
+
+		placeholder := remaining[start+1 : start+end]
+		switch placeholder {
+		case "":
+			return nil, fmt.Errorf("empty placeholder in template '%s'", text)
+		case "prefix":
+			t.tokens = append(t.tokens, token{prefixToken, prefix})
+			expression.WriteString(regexp.QuoteMeta(prefix))
+		case "seq":
+			t.tokens = append(t.tokens, token{sequenceToken, ""})
+			expression.WriteString(`(\d+)`)
+			named = true
+		default:
+			t.tokens = append(t.tokens, token{timeToken, placeholder})
+			expression.WriteString(`(.+?)`)
+			named = true
+		}
+		remaining = remaining[start+end+1:]
+	}
+
+	if !named {
+		return nil, fmt.Errorf("template '%s' requires a sequence or time placeholder", text)
+	}
+
+	expression.WriteString("$")
+	pattern, err := regexp.Compile(expression.String())
+	if err != nil {
+		return nil, err
+	}
+	t.pattern = pattern
+	return t, nil
+}
+
+// sequenced indicates whether the template includes a sequence number.
+func (t *nameTemplate) sequenced() bool {
+	for _, v := range t.tokens {
+		if v.kind == sequenceToken {
+			return true
+		}
+	}
+	return false
+}
+
+// resolution is the shortest time between two snapshots which the template names differently. Layouts coarser than a
+// month are taken to change yearly.
+func (t *nameTemplate) resolution() time.Duration {
+	if t.sequenced() {
+		return 0
+	}
+
+	reference := time.Date(2006, time.January, 2, 15, 4, 5, 0, time.Local)
+	for _, v := range []time.Duration{time.Second, time.Minute, time.Hour, 24 * time.Hour, 31 * 24 * time.Hour} {
+		if t.format(0, reference) != t.format(0, reference.Add(v)) {
+			return v
+		}
+	}
+	return 366 * 24 * time.Hour
+}
+
+// unique checks that the template names consecutive snapshots of the entry differently. A template without a sequence
+// number relies on its time layout which must change between each occurrence of the schedule or within the interval.
+func (e SnapEntry) unique(t *nameTemplate, now time.Time) error {
+	if t.sequenced() {
+		return nil
+	}
+
+	if e.Schedule != "" {
+		schedule, err := parseSchedule(e.Schedule)
+		if err != nil {
+			return fmt.Errorf("could not parse schedule '%s': %w", e.Schedule, err)
+		}
+
+		// The upcoming occurrences are checked as a schedule may be irregular (e.g. several times on weekdays).
+		previous := schedule.next(now)
+		for i := 0; i < 32 && !previous.IsZero(); i++ {
+			next := schedule.next(previous)
+			if !next.IsZero() && t.format(0, previous) == t.format(0, next) {
+				return fmt.Errorf("template '%s' gives the snapshots at %s and %s the same name", e.Template, previous.Format(time.RFC3339), next.Format(time.RFC3339))
+			}
+			previous = next
+		}
+		return nil
+	}
+
+	interval, err := e.IntervalDuration()
+	if err != nil {
+		return fmt.Errorf("could not parse interval '%s': %w", e.Interval, err)
+	}
+
+	if resolution := t.resolution(); interval < resolution {
+		return fmt.Errorf("template '%s' changes every %s which is longer than the interval of %s", e.Template, resolution, interval)
+	}
+	return nil
+}
+
+func (t *nameTemplate) format(sequence int, now time.Time) string {
+	var sb strings.Builder
+	for _, v := range t.tokens {
+		switch v.kind {
+		case sequenceToken:
+			sb.WriteString(padNumber(sequence))
+		case timeToken:
+			sb.WriteString(now.Format(v.text))
+		default:
+			sb.WriteString(v.text)
+		}
+	}
+	return sb.String()
+}
+
+// matches indicates whether the name was generated by the template.
+func (t *nameTemplate) matches(name string) bool {
+	_, ok := t.parse(name)
+	return ok
+}
+
+// parse recognises a name generated by the template.
+func (t *nameTemplate) parse(name string) (*snapshotName, bool) {
+	groups := t.pattern.FindStringSubmatch(name)
+	if groups == nil {
+		return nil, false
+	}
+
+	parsed := &snapshotName{}
+	group := 1
+	for _, v := range t.tokens {
+		switch v.kind {
+		case sequenceToken:
+			seq, err := strconv.Atoi(groups[group])
+			if err != nil {
+				return nil, false
+			}
+			parsed.sequence = seq
+			group++
+		case timeToken:
+			if _, err := time.ParseInLocation(v.text, groups[group], time.Local); err != nil {
+				return nil, false
+			}
+			group++
+		}
+	}
+	return parsed, true
+}
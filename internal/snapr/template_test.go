@@ -0,0 +1,66 @@
+package snapr
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTemplateParse(t *testing.T) {
+	template, err := parseTemplate("{prefix}-{2006-01-02_15:04}", "daily")
+	assert.NoError(t, err)
+	assert.False(t, template.sequenced())
+
+	now := time.Date(2021, time.October, 6, 21, 11, 0, 0, time.Local)
+	name := template.format(0, now)
+	assert.Equal(t, "daily-2021-10-06_21:11", name)
+
+	_, ok := template.parse(name)
+	assert.True(t, ok)
+
+	assert.False(t, template.matches("daily-2021-13-06_21:11"))
+	assert.False(t, template.matches("hourly-2021-10-06_21:11"))
+	assert.False(t, template.matches("daily-00001"))
+}
+
+func TestTemplateDefault(t *testing.T) {
+	template, err := SnapEntry{Prefix: "daily"}.template()
+	assert.NoError(t, err)
+	assert.True(t, template.sequenced())
+	assert.Equal(t, "daily-00010", template.format(10, time.Now()))
+
+	parsed, ok := template.parse("daily-00010")
+	assert.True(t, ok)
+	assert.Equal(t, 10, parsed.sequence)
+
+	assert.False(t, template.matches("daily-"))
+	assert.False(t, template.matches("daily-weekly-00010"))
+}
+
+func TestTemplateInvalid(t *testing.T) {
+	for _, text := range []string{"{prefix}", "{prefix}-{seq", "{prefix}-{}-{seq}", "static"} {
+		_, err := parseTemplate(text, "daily")
+		assert.Error(t, err, text)
+	}
+}
+
+func TestTemplateUnique(t *testing.T) {
+	now := time.Date(2021, time.October, 6, 21, 11, 0, 0, time.Local)
+
+	daily, err := parseTemplate("{prefix}-{2006-01-02}", "daily")
+	assert.NoError(t, err)
+	assert.Equal(t, 24*time.Hour, daily.resolution())
+
+	// A layout coarser than the interval or schedule would name consecutive snapshots the same.
+	assert.Error(t, SnapEntry{Interval: "23h59m59s", Template: "{prefix}-{2006-01-02}"}.unique(daily, now))
+	assert.Error(t, SnapEntry{Interval: "1h", Template: "{prefix}-{2006-01-02}"}.unique(daily, now))
+	assert.NoError(t, SnapEntry{Interval: "24h", Template: "{prefix}-{2006-01-02}"}.unique(daily, now))
+	assert.Error(t, SnapEntry{Schedule: "Mon..Fri 06,18:00", Template: "{prefix}-{2006-01-02}"}.unique(daily, now))
+	assert.NoError(t, SnapEntry{Schedule: "Mon..Fri 18:00", Template: "{prefix}-{2006-01-02}"}.unique(daily, now))
+
+	// A sequence number names every snapshot differently.
+	sequenced, err := parseTemplate("{prefix}-{2006-01-02}-{seq}", "daily")
+	assert.NoError(t, err)
+	assert.NoError(t, SnapEntry{Interval: "1h"}.unique(sequenced, now))
+}
@@ -3,9 +3,12 @@ package snapr
 import (
 	"context"
 	"crypto/sha1"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"hash"
 	"io"
+	"net/http"
 	"snapr/internal/stow"
 	"strings"
 	"time"
@@ -23,6 +26,10 @@ type upload struct {
 	free       chan *request
 	pending    chan *request
 	progress   progress
+	budget     *budget
+	reserved   int64
+	held       bool
+	resume     *resumption
 }
 
 type request struct {
@@ -32,11 +39,15 @@ type request struct {
 	volume     int
 	part       int
 	buffer     []byte
+	hash       string
 	response   *stow.Part
 }
 
-func newUpload(ctx context.Context, stow *stow.Stow, bucket, path string, threads, partSize, volumeSize int) (*upload, error) {
-	volumes, err := makeVolumes(ctx, stow, bucket, path)
+// newUpload prepares an upload of the path. The threads and their buffers are drawn from the budget and are returned
+// once Send completes or the upload is closed. If wait is false an exhausted budget results in an error. Volumes are
+// started once sending begins.
+func newUpload(ctx context.Context, stow *stow.Stow, bucket, path string, threads, partSize, volumeSize int, budget *budget, wait bool) (*upload, error) {
+	threads, reserved, err := budget.reserve(ctx, threads, partSize, wait)
 	if err != nil {
 		return nil, err
 	}
@@ -47,10 +58,12 @@ func newUpload(ctx context.Context, stow *stow.Stow, bucket, path string, thread
 		bucket:     bucket,
 		path:       path,
 		volumeSize: volumeSize,
-		volumes:    volumes,
+		volumes:    make([]volume, 0),
 		free:       makeRequests(threads, partSize),
 		pending:    make(chan *request, threads),
 		progress:   progress{time.Now(), 0, 0, sha1.New()},
+		budget:     budget,
+		reserved:   reserved,
 	}, nil
 }
 
@@ -66,18 +79,16 @@ func makeRequests(threads, partSize int) chan *request {
 	return unused
 }
 
-func makeVolumes(ctx context.Context, stow *stow.Stow, bucket, path string) ([]volume, error) {
-	v, err := newVolume(ctx, stow, 0, bucket, path)
+// Send will upload the source. Interim files will be removed if there's an error and abort is true.
+func (u *upload) Send(src io.Reader, abort bool) (*SendDetails, error) {
+	defer u.close()
+
+	first, err := u.newVolume(0)
 	if err != nil {
 		return nil, err
 	}
+	u.volumes = append(u.volumes, *first)
 
-	volumes := []volume{*v}
-	return volumes, nil
-}
-
-// Send will upload the source. Interim files will be removed if there's an error and abort is true.
-func (u *upload) Send(src io.Reader, abort bool) (*SendDetails, error) {
 	eg, ctx := errgroup.WithContext(u.ctx)
 
 	for i := 0; i < cap(u.free); i++ {
@@ -99,6 +110,11 @@ func (u *upload) Send(src io.Reader, abort bool) (*SendDetails, error) {
 				break
 			} else if err != io.ErrUnexpectedEOF {
 				close(u.pending)
+
+				// A part which failed cancels reading so its error is reported rather than the cancellation.
+				if failed := eg.Wait(); failed != nil {
+					err = failed
+				}
 				return nil, u.Fail(abort, err)
 			}
 		}
@@ -119,32 +135,68 @@ func (u *upload) Send(src io.Reader, abort bool) (*SendDetails, error) {
 	for _, v := range u.volumes {
 		err := u.complete(&v)
 		if err != nil {
-			return nil, err
+			return nil, u.Fail(abort, err)
 		}
 	}
 
+	u.resume.remove()
 	return u.result(), nil
 }
 
+// close returns the threads and buffers of the upload to the budget.
+func (u *upload) close() {
+	u.budget.free(u.reserved)
+	u.reserved = 0
+}
+
+// Fail aborts the upload if abort is true. A resumable upload is left in place to be continued by the next send unless
+// the stream has diverged from the one originally uploaded or the multi-part upload no longer exists.
 func (u *upload) Fail(abort bool, cause error) error {
 	if abort {
-		if err := u.abort(); err != nil {
+		if u.resume != nil && !missing(cause) && !errors.Is(cause, errDiverged) {
+			Logger.Warn().Msgf("upload of %s was interrupted and will be resumed", u.path)
+			return cause
+		}
+
+		// The upload is abandoned even if it can't be aborted so the next send doesn't try to resume it.
+		err := u.abort()
+		u.resume.remove()
+		if err != nil {
 			return fmt.Errorf("abort failed: %s following %w", err, cause)
 		}
 	}
 	return cause
 }
 
+// missing indicates whether the error is due to a multi-part upload which no longer exists.
+func missing(err error) bool {
+	var statusError *stow.StatusError
+	return errors.As(err, &statusError) && statusError.StatusCode == http.StatusNotFound
+}
+
+// abort aborts the multi-part upload of each volume. A volume which was already completed or aborted is skipped.
 func (u *upload) abort() error {
 	ctx := context.Background()
 	for _, v := range u.volumes {
 		if !v.aborted {
-			if _, err := u.stow.AbortMultipartUpload(ctx, v.bucket, v.key, v.identifier); err != nil {
+			if _, err := u.stow.AbortMultipartUpload(ctx, v.bucket, v.key, v.identifier); err != nil && !missing(err) {
 				return err
 			}
 			v.aborted = true
 		}
 	}
+
+	// Volumes started before an interruption may not have been reached again.
+	for i := len(u.volumes); ; i++ {
+		v, ok := u.resume.volume(i)
+		if !ok {
+			break
+		}
+
+		if _, err := u.stow.AbortMultipartUpload(ctx, u.bucket, v.Key, v.Identifier); err != nil && !missing(err) {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -194,7 +246,7 @@ func (u *upload) volume(max int) (*volume, int, error) {
 	cap := min(max, (u.volumeSize - u.volumes[last].progress.bytes))
 
 	if cap == 0 {
-		vol, err := newVolume(u.ctx, u.stow, (last + 1), u.bucket, u.path)
+		vol, err := u.newVolume(last + 1)
 		if err != nil {
 			return nil, 0, err
 		}
@@ -222,12 +274,37 @@ func (u *upload) enqueue(req *request, vol *volume, read int) error {
 	req.volume = vol.sequence
 	req.part = vol.progress.parts
 
+	if u.resume != nil {
+		sum := sha1.Sum(req.buffer)
+		req.hash = hex.EncodeToString(sum[:])
+
+		// Parts uploaded before an interruption are skipped if the stream is unchanged.
+		if part, ok := u.resume.part(req.volume, req.part); ok {
+			if part.Hash != req.hash || part.Size != read {
+				return fmt.Errorf("part %d of volume %d of %s (%w)", req.part, req.volume, u.path, errDiverged)
+			}
+
+			response := stow.NewPart(req.part, part.Tag)
+			req.response = &response
+			u.free <- req
+			return nil
+		}
+	}
+
 	u.pending <- req
 	return nil
 }
 
+// takeRequests uploads pending parts. A thread is taken from the budget for each part unless the upload's threads are
+// already held.
 func (u *upload) takeRequests(ctx context.Context) error {
 	for req := range u.pending {
+		if !u.held {
+			if err := u.budget.acquire(ctx); err != nil {
+				return err
+			}
+		}
+
 		res, err := u.stow.UploadPart(
 			u.ctx,
 			req.bucket,
@@ -236,12 +313,19 @@ func (u *upload) takeRequests(ctx context.Context) error {
 			req.part,
 			req.buffer,
 		)
+		if !u.held {
+			u.budget.release()
+		}
 		if err != nil {
 			return err
 		}
 
 		Logger.Debug().Msgf("part %d of volume %d uploaded", req.part, req.volume)
 
+		if err := u.resume.addPart(req.volume, req.part, partState{Tag: res.Tag, Hash: req.hash, Size: len(req.buffer)}); err != nil {
+			Logger.Warn().Msgf("failed to record progress of %s: %s", u.path, err)
+		}
+
 		part := stow.NewPart(req.part, res.Tag)
 		req.response = &part
 
@@ -290,6 +374,31 @@ type volume struct {
 	aborted    bool
 }
 
+// newVolume starts the numbered volume or continues its multi-part upload if it was interrupted.
+func (u *upload) newVolume(sequence int) (*volume, error) {
+	if v, ok := u.resume.volume(sequence); ok {
+		return &volume{
+			sequence:   sequence,
+			path:       u.path,
+			bucket:     u.bucket,
+			key:        v.Key,
+			identifier: v.Identifier,
+			progress:   progress{time.Now(), 0, 0, sha1.New()},
+			parts:      makeParts(),
+		}, nil
+	}
+
+	v, err := newVolume(u.ctx, u.stow, sequence, u.bucket, u.path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := u.resume.addVolume(sequence, v.key, v.identifier); err != nil {
+		Logger.Warn().Msgf("failed to record progress of %s: %s", u.path, err)
+	}
+	return v, nil
+}
+
 func newVolume(ctx context.Context, stow *stow.Stow, sequence int, bucket, path string) (*volume, error) {
 	key := fmt.Sprintf("%s/%s", path, padNumber(sequence))
 	res, err := stow.CreateMultipartUpload(ctx, bucket, key)
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/xml"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -73,7 +74,7 @@ func (r GetObjectRequest) formRequest(factory requestFactory, p Provider) (*http
 		return nil, err
 	}
 
-	if r.End > r.Begin {
+	if r.End > 0 && r.End >= r.Begin {
 		req.Header.Add("Range", "bytes="+strconv.Itoa(r.Begin)+"-"+strconv.Itoa(r.End))
 	}
 	return req, nil
@@ -90,6 +91,17 @@ type GetObjectResponse struct {
 	Metadata Metadata
 }
 
+// GetObjectStreamResponse is used to model the GetObject response when the content is read from the body.
+type GetObjectStreamResponse struct {
+	Tag      string
+	Modified time.Time
+	Begin    int
+	End      int
+	Size     int
+	Body     io.ReadCloser
+	Metadata Metadata
+}
+
 // Object records a stored object's properties.
 type Object struct {
 	Key          string    `xml:"Key"`
@@ -156,26 +168,47 @@ func (s *Stow) ListObjects(ctx context.Context, bucket, continuation string) (*L
 
 // GetObject will get an object (see: https://docs.aws.amazon.com/AmazonS3/latest/API/API_GetObject.html).
 func (s *Stow) GetObject(ctx context.Context, bucket, path string, begin, end int) (*GetObjectResponse, error) {
-	res, err := s.doOperation(GetObjectRequest{ctx, bucket, path, begin, end})
+	stream, err := s.GetObjectStream(ctx, bucket, path, begin, end)
+	if err != nil {
+		return nil, err
+	}
+
+	defer stream.Body.Close()
 
+	b, err := ioutil.ReadAll(stream.Body)
 	if err != nil {
 		return nil, err
 	}
 
-	defer res.Body.Close()
+	return &GetObjectResponse{
+		Tag:      stream.Tag,
+		Modified: stream.Modified,
+		Begin:    stream.Begin,
+		End:      stream.End,
+		Size:     stream.Size,
+		Content:  b,
+		Metadata: stream.Metadata,
+	}, nil
+}
+
+// GetObjectStream will get an object without reading its content. The caller must close the body.
+func (s *Stow) GetObjectStream(ctx context.Context, bucket, path string, begin, end int) (*GetObjectStreamResponse, error) {
+	res, err := s.doOperation(GetObjectRequest{ctx, bucket, path, begin, end})
 
-	b, err := ioutil.ReadAll(res.Body)
 	if err != nil {
 		return nil, err
 	}
 
 	if res.StatusCode != 200 && res.StatusCode != 206 {
+		defer res.Body.Close()
+		b, _ := ioutil.ReadAll(res.Body)
 		return nil, newStatusError(fmt.Sprintf("failed getting object '%s' from '%s'", path, bucket), *res, b)
 	}
 
-	response := &GetObjectResponse{
+	response := &GetObjectStreamResponse{
 		Tag:      res.Header.Get("ETag"),
 		Metadata: newMetadata(res),
+		Body:     res.Body,
 	}
 
 	modified, err := time.Parse(time.RFC1123, res.Header.Get(header.lastModified))
@@ -183,8 +216,12 @@ func (s *Stow) GetObject(ctx context.Context, bucket, path string, begin, end in
 		response.Modified = modified
 	}
 
-	response.Begin, response.End, response.Size, _ = parseContentRange(res.Header)
-	response.Content = b
+	// A response without a range holds the whole object.
+	response.Begin, response.End, response.Size, err = parseContentRange(res.Header)
+	if err != nil && res.ContentLength > 0 {
+		response.End = int(res.ContentLength) - 1
+		response.Size = int(res.ContentLength)
+	}
 	return response, nil
 }
 
@@ -1,10 +1,15 @@
 package stow
 
 import (
+	"context"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestContentRange(t *testing.T) {
@@ -16,3 +21,58 @@ func TestContentRange(t *testing.T) {
 	assert.Equal(t, end, 9)
 	assert.Equal(t, size, 443)
 }
+
+// unread records whether a body has been read.
+type unread struct {
+	io.Reader
+	read bool
+}
+
+func (u *unread) Read(p []byte) (int, error) {
+	u.read = true
+	return u.Reader.Read(p)
+}
+
+func (u *unread) Close() error {
+	return nil
+}
+
+func TestGetObjectStream(t *testing.T) {
+	body := &unread{Reader: strings.NewReader("0123456789")}
+	var requested string
+
+	settings, err := NewSettings(
+		Use("s3.test.example.com", "test"),
+		WithCredentials("account", "secret"),
+		func(s *Settings) error {
+			s.Forwarder = func(req *http.Request) (*http.Response, error) {
+				requested = req.Header.Get("Range")
+				header := http.Header{}
+				header.Set("ETag", "tag")
+				header.Set("Content-Range", "bytes 10-19/443")
+				return &http.Response{StatusCode: http.StatusPartialContent, Header: header, Body: body}, nil
+			}
+			return nil
+		},
+	)
+	require.NoError(t, err)
+	s, err := New(settings)
+	require.NoError(t, err)
+
+	res, err := s.GetObjectStream(context.Background(), "bucket", "key", 10, 19)
+	require.NoError(t, err)
+	assert.Equal(t, "bytes=10-19", requested)
+	assert.Equal(t, "tag", res.Tag)
+	assert.Equal(t, []int{10, 19, 443}, []int{res.Begin, res.End, res.Size})
+
+	// The content is left to be read by the caller.
+	assert.False(t, body.read)
+	content, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789", string(content))
+
+	// A single byte is requested as a range.
+	_, err = s.GetObjectStream(context.Background(), "bucket", "key", 19, 19)
+	require.NoError(t, err)
+	assert.Equal(t, "bytes=19-19", requested)
+}
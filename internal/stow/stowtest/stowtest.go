@@ -0,0 +1,290 @@
+// Package stowtest provides an in-memory S3 compatible storage provider for testing.
+package stowtest
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"snapr/internal/stow"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var byteRange = regexp.MustCompile(`^bytes=(\d+)-(\d+)$`)
+
+// Provider stores objects in memory and serves a subset of the S3 REST API through its Forward method.
+type Provider struct {
+	endpoint string
+	mu       sync.Mutex
+	sequence int
+	objects  map[string]map[string]*object
+	uploads  map[string]*multipart
+	// Fail allows a test to inject a failure for a request. A non-nil error is returned instead of performing the request.
+	Fail func(*http.Request) error
+}
+
+type object struct {
+	data     []byte
+	tag      string
+	modified time.Time
+}
+
+type multipart struct {
+	bucket string
+	key    string
+	parts  map[int][]byte
+}
+
+// New instantiates an empty provider for the endpoint.
+func New(endpoint string) *Provider {
+	return &Provider{
+		endpoint: endpoint,
+		objects:  make(map[string]map[string]*object),
+		uploads:  make(map[string]*multipart),
+	}
+}
+
+// Keys lists all keys in a bucket.
+func (p *Provider) Keys(bucket string) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	keys := make([]string, 0)
+	for key := range p.objects[bucket] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Object retrieves the content of an object.
+func (p *Provider) Object(bucket, key string) ([]byte, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	o, ok := p.objects[bucket][key]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte(nil), o.data...), true
+}
+
+// Delete removes an object.
+func (p *Provider) Delete(bucket, key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.objects[bucket], key)
+}
+
+// Uploads returns the number of multi-part uploads in progress.
+func (p *Provider) Uploads() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return len(p.uploads)
+}
+
+// Forward serves a request. It satisfies stow.Forwarder.
+func (p *Provider) Forward(req *http.Request) (*http.Response, error) {
+	if p.Fail != nil {
+		if err := p.Fail(req); err != nil {
+			return nil, err
+		}
+	}
+
+	var body []byte
+	if req.Body != nil {
+		b, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		body = b
+	}
+
+	bucket := strings.TrimSuffix(req.URL.Hostname(), "."+p.endpoint)
+	key := strings.TrimPrefix(req.URL.Path, "/")
+	query := req.URL.Query()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch {
+	case req.Method == http.MethodGet && key == "" && query.Get("list-type") == "2":
+		return p.list(req, bucket)
+	case req.Method == http.MethodGet:
+		return p.get(req, bucket, key)
+	case req.Method == http.MethodPut && query.Get("uploadId") != "":
+		return p.uploadPart(req, query.Get("uploadId"), query.Get("partNumber"), body)
+	case req.Method == http.MethodPut:
+		return p.put(req, bucket, key, body)
+	case req.Method == http.MethodPost && query["uploads"] != nil:
+		return p.create(req, bucket, key)
+	case req.Method == http.MethodPost && query.Get("uploadId") != "":
+		return p.complete(req, query.Get("uploadId"), body)
+	case req.Method == http.MethodDelete && query.Get("uploadId") != "":
+		return p.abort(req, query.Get("uploadId"))
+	}
+	return nil, status(http.StatusNotImplemented, "unsupported request")
+}
+
+func status(code int, message string) error {
+	return &stow.StatusError{
+		Description: "request failed",
+		StatusCode:  code,
+		Status:      http.StatusText(code),
+		Message:     message,
+	}
+}
+
+func respond(req *http.Request, code int, header http.Header, body []byte) *http.Response {
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode:    code,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+func respondXML(req *http.Request, v interface{}) (*http.Response, error) {
+	b, err := xml.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return respond(req, http.StatusOK, nil, b), nil
+}
+
+func tag(data []byte) string {
+	return fmt.Sprintf("\"%x\"", md5.Sum(data))
+}
+
+func (p *Provider) list(req *http.Request, bucket string) (*http.Response, error) {
+	result := stow.ListObjectsResponse{Name: bucket}
+	keys := make([]string, 0)
+	for key := range p.objects[bucket] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		o := p.objects[bucket][key]
+		result.Objects = append(result.Objects, stow.Object{Key: key, CreationDate: o.modified, Tag: o.tag, Size: len(o.data)})
+	}
+	result.KeyCount = len(result.Objects)
+	return respondXML(req, result)
+}
+
+func (p *Provider) get(req *http.Request, bucket, key string) (*http.Response, error) {
+	o, ok := p.objects[bucket][key]
+	if !ok {
+		return nil, status(http.StatusNotFound, fmt.Sprintf("no such key '%s'", key))
+	}
+
+	header := http.Header{}
+	header.Set("ETag", o.tag)
+	header.Set("Last-Modified", o.modified.Format(time.RFC1123))
+
+	match := byteRange.FindStringSubmatch(req.Header.Get("Range"))
+	if match == nil {
+		return respond(req, http.StatusOK, header, o.data), nil
+	}
+
+	begin, _ := strconv.Atoi(match[1])
+	end, _ := strconv.Atoi(match[2])
+	if begin >= len(o.data) {
+		return nil, status(http.StatusRequestedRangeNotSatisfiable, "invalid range")
+	}
+	if end >= len(o.data) {
+		end = len(o.data) - 1
+	}
+
+	header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", begin, end, len(o.data)))
+	return respond(req, http.StatusPartialContent, header, o.data[begin:end+1]), nil
+}
+
+func (p *Provider) put(req *http.Request, bucket, key string, data []byte) (*http.Response, error) {
+	if _, ok := p.objects[bucket]; !ok {
+		p.objects[bucket] = make(map[string]*object)
+	}
+
+	o := &object{data, tag(data), time.Now().UTC()}
+	p.objects[bucket][key] = o
+
+	header := http.Header{}
+	header.Set("ETag", o.tag)
+	return respond(req, http.StatusOK, header, nil), nil
+}
+
+func (p *Provider) create(req *http.Request, bucket, key string) (*http.Response, error) {
+	p.sequence++
+	identifier := fmt.Sprintf("upload-%d", p.sequence)
+	p.uploads[identifier] = &multipart{bucket, key, make(map[int][]byte)}
+
+	return respondXML(req, stow.CreateMultipartUploadResponse{Bucket: bucket, Key: key, Identifier: identifier})
+}
+
+func (p *Provider) uploadPart(req *http.Request, identifier, number string, data []byte) (*http.Response, error) {
+	upload, ok := p.uploads[identifier]
+	if !ok {
+		return nil, status(http.StatusNotFound, "no such upload")
+	}
+
+	part, err := strconv.Atoi(number)
+	if err != nil {
+		return nil, status(http.StatusBadRequest, "invalid part number")
+	}
+	upload.parts[part] = data
+
+	header := http.Header{}
+	header.Set("ETag", tag(data))
+	return respond(req, http.StatusOK, header, nil), nil
+}
+
+func (p *Provider) complete(req *http.Request, identifier string, body []byte) (*http.Response, error) {
+	upload, ok := p.uploads[identifier]
+	if !ok {
+		return nil, status(http.StatusNotFound, "no such upload")
+	}
+
+	var request stow.CompleteMultipartUploadRequest
+	if err := xml.Unmarshal(body, &request); err != nil {
+		return nil, status(http.StatusBadRequest, err.Error())
+	}
+
+	var data []byte
+	for _, part := range request.Parts {
+		content, ok := upload.parts[part.PartNumber]
+		if !ok || tag(content) != part.Tag {
+			return nil, status(http.StatusBadRequest, fmt.Sprintf("invalid part %d", part.PartNumber))
+		}
+		data = append(data, content...)
+	}
+
+	delete(p.uploads, identifier)
+	if _, err := p.put(req, upload.bucket, upload.key, data); err != nil {
+		return nil, err
+	}
+
+	o := p.objects[upload.bucket][upload.key]
+	return respondXML(req, stow.CompleteMultipartUploadResponse{Bucket: upload.bucket, Key: upload.key, Tag: o.tag})
+}
+
+func (p *Provider) abort(req *http.Request, identifier string) (*http.Response, error) {
+	if _, ok := p.uploads[identifier]; !ok {
+		return nil, status(http.StatusNotFound, "no such upload")
+	}
+	delete(p.uploads, identifier)
+	return respond(req, http.StatusNoContent, nil, nil), nil
+}
@@ -3,6 +3,7 @@ package zed
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"os/exec"
 	"strconv"
@@ -29,6 +30,33 @@ func ToFileSystem(fs string) (*FileSystem, error) {
 	return &FileSystem{splits[0], splits[1]}, nil
 }
 
+// ListFileSystems lists a file system and all of its descendant file systems and volumes.
+func (z *Zed) ListFileSystems(ctx context.Context, fs FileSystem) ([]FileSystem, error) {
+	cmd := exec.CommandContext(ctx, z.path, "list", "-H", "-r", "-t", "filesystem,volume", "-o", "name", fs.String())
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	listing := make([]FileSystem, 0)
+
+	scanner := bufio.NewScanner(strings.NewReader(string(out)))
+	for scanner.Scan() {
+		child, err := ToFileSystem(scanner.Text())
+		if err != nil {
+			return nil, err
+		}
+		listing = append(listing, *child)
+	}
+	return listing, nil
+}
+
+// Contains indicates whether the other file system is this file system or one of its descendants.
+func (f FileSystem) Contains(other FileSystem) bool {
+	return f == other || strings.HasPrefix(other.String(), f.String()+"/")
+}
+
 // SetProperty will set a user property on the file system.
 func (z *Zed) SetProperty(ctx context.Context, fs FileSystem, domain, property, value string) error {
 	cmd := exec.CommandContext(ctx, z.path, "set", domain+":"+property+"="+value, fs.String())
@@ -39,6 +67,17 @@ func (z *Zed) SetProperty(ctx context.Context, fs FileSystem, domain, property,
 	return nil
 }
 
+// GetProperty retrieves a user property set locally on the file system. An empty string is returned if the property is
+// not set or only inherited.
+func (z *Zed) GetProperty(ctx context.Context, fs FileSystem, domain, property string) (string, error) {
+	cmd := exec.CommandContext(ctx, z.path, "get", "-H", "-s", "local", "-o", "value", domain+":"+property, fs.String())
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to get property '%s:%s': %s (%w)", domain, property, parseError(out), err)
+	}
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
+
 // Bookmark represents a bookmark of a snapshot.
 type Bookmark struct {
 	Addr   Address
@@ -52,13 +91,15 @@ func (b Bookmark) Address() string {
 
 // BookmarkListing represents a bookmark with associated meta-data.
 type BookmarkListing struct {
-	Bookmark Bookmark
-	Created  time.Time
+	Bookmark    Bookmark
+	Created     time.Time
+	Identity    string
+	Transaction int
 }
 
-// ListBookmarks lists all bookmarks for a file system.
+// ListBookmarks lists all bookmarks for a file system excluding those of descendant file systems.
 func (z *Zed) ListBookmarks(ctx context.Context, fs FileSystem) ([]BookmarkListing, error) {
-	cmd := exec.CommandContext(ctx, z.path, "list", "-H", "-r", "-t", "bookmark", "-o", "name,creation", fs.String())
+	cmd := exec.CommandContext(ctx, z.path, "list", "-H", "-d", "1", "-t", "bookmark", "-o", "name,creation,guid,createtxg", "-s", "createtxg", fs.String())
 
 	out, err := cmd.Output()
 	if err != nil {
@@ -70,8 +111,8 @@ func (z *Zed) ListBookmarks(ctx context.Context, fs FileSystem) ([]BookmarkListi
 	scanner := bufio.NewScanner(strings.NewReader(string(out)))
 	for scanner.Scan() {
 		row := scanner.Text()
-		fields := strings.SplitN(row, "\t", 2)
-		if len(fields) != 2 {
+		fields := strings.SplitN(row, "\t", 4)
+		if len(fields) != 4 {
 			return nil, fmt.Errorf("list bookmarks failed: error parsing row '%s'", row)
 		}
 
@@ -80,12 +121,22 @@ func (z *Zed) ListBookmarks(ctx context.Context, fs FileSystem) ([]BookmarkListi
 			return nil, err
 		}
 
+		// The depth already limits the listing to the file system itself.
+		if addr.FileSystem != fs {
+			continue
+		}
+
 		creation, err := time.ParseInLocation(creationTime, fields[1], time.Local)
 		if err != nil {
 			return nil, err
 		}
 
-		listing = append(listing, BookmarkListing{Bookmark{*addr, true}, creation.UTC()})
+		transaction, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return nil, err
+		}
+
+		listing = append(listing, BookmarkListing{Bookmark{*addr, true}, creation.UTC(), fields[2], transaction})
 	}
 	return listing, nil
 }
@@ -119,22 +170,28 @@ type SnapshotListing struct {
 	Holds       []string
 }
 
-// ListSnapshots lists all snapshots for a target.
+// ListSnapshots lists all snapshots for a target excluding those of descendant file systems. Holds are retrieved in batches
+// for only those snapshots which have user references so the number of processes does not grow with the number of snapshots.
 func (z *Zed) ListSnapshots(ctx context.Context, target FileSystem) ([]SnapshotListing, error) {
-	cmd := exec.CommandContext(ctx, z.path, "list", "-H", "-r", "-t", "snapshot", "-o", "name,creation,guid,createtxg", "-s", "createtxg", target.String())
+	cmd := exec.CommandContext(ctx, z.path, "list", "-H", "-p", "-d", "1", "-t", "snapshot", "-o", "name,creation,guid,createtxg,userrefs", "-s", "createtxg", target.String())
 
 	out, err := cmd.Output()
 	if err != nil {
+		var exitError *exec.ExitError
+		if errors.As(err, &exitError) && strings.Contains(string(exitError.Stderr), ErrNotExist.Error()) {
+			return nil, ErrNotExist
+		}
 		return nil, err
 	}
 
 	listing := make([]SnapshotListing, 0)
+	referenced := make([]Snapshot, 0)
 
 	scanner := bufio.NewScanner(strings.NewReader(string(out)))
 	for scanner.Scan() {
 		row := scanner.Text()
-		fields := strings.SplitN(row, "\t", 4)
-		if len(fields) != 4 {
+		fields := strings.SplitN(row, "\t", 5)
+		if len(fields) != 5 {
 			return nil, fmt.Errorf("list snapshots failed: error parsing row '%s'", row)
 		}
 
@@ -143,7 +200,12 @@ func (z *Zed) ListSnapshots(ctx context.Context, target FileSystem) ([]SnapshotL
 			return nil, err
 		}
 
-		creation, err := time.ParseInLocation(creationTime, fields[1], time.Local)
+		// The depth already limits the listing to the file system itself.
+		if addr.FileSystem != target {
+			continue
+		}
+
+		creation, err := strconv.ParseInt(fields[1], 10, 64)
 		if err != nil {
 			return nil, err
 		}
@@ -153,13 +215,28 @@ func (z *Zed) ListSnapshots(ctx context.Context, target FileSystem) ([]SnapshotL
 			return nil, err
 		}
 
-		snapshot := Snapshot{*addr}
-		holds, err := z.ListHolds(ctx, snapshot)
+		references, err := strconv.Atoi(fields[4])
 		if err != nil {
 			return nil, err
 		}
 
-		listing = append(listing, SnapshotListing{snapshot, creation.UTC(), fields[2], transaction, holds})
+		snapshot := Snapshot{*addr}
+		if references > 0 {
+			referenced = append(referenced, snapshot)
+		}
+
+		listing = append(listing, SnapshotListing{snapshot, time.Unix(creation, 0).UTC(), fields[2], transaction, make([]string, 0)})
+	}
+
+	holds, err := z.listHolds(ctx, referenced)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range listing {
+		if v, ok := holds[listing[i].Snapshot.Address()]; ok {
+			listing[i].Holds = v
+		}
 	}
 	return listing, nil
 }
@@ -174,6 +251,35 @@ func (z *Zed) CreateSnapshot(ctx context.Context, snapshot Snapshot) error {
 	return nil
 }
 
+// CreateRecursiveSnapshot atomically creates a snapshot of a file system and all of its descendants.
+func (z *Zed) CreateRecursiveSnapshot(ctx context.Context, snapshot Snapshot) error {
+	cmd := exec.CommandContext(ctx, z.path, "snapshot", "-r", snapshot.Address())
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to snapshot '%s': %s (%w)", snapshot.Address(), parseError(out), err)
+	}
+	return nil
+}
+
+// CreateSnapshots atomically creates a list of snapshots.
+func (z *Zed) CreateSnapshots(ctx context.Context, snapshots []Snapshot) error {
+	if len(snapshots) == 0 {
+		return fmt.Errorf("failed to snapshot: no snapshots")
+	}
+
+	args := []string{"snapshot"}
+	for _, snapshot := range snapshots {
+		args = append(args, snapshot.Address())
+	}
+
+	cmd := exec.CommandContext(ctx, z.path, args...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to snapshot '%s': %s (%w)", snapshots[0].Address(), parseError(out), err)
+	}
+	return nil
+}
+
 // HoldSnapshot places a hold on a snapshot.
 func (z *Zed) HoldSnapshot(ctx context.Context, snapshot Snapshot, tag string) error {
 	cmd := exec.CommandContext(ctx, z.path, "hold", tag, snapshot.Address())
@@ -197,24 +303,61 @@ func (z *Zed) ReleaseSnapshot(ctx context.Context, snapshot Snapshot, tag string
 	return nil
 }
 
+// Rollback reverts a file system to a snapshot. Later snapshots are destroyed.
+func (z *Zed) Rollback(ctx context.Context, snapshot Snapshot) error {
+	cmd := exec.CommandContext(ctx, z.path, "rollback", "-r", snapshot.Address())
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to roll back to '%s': %s (%w)", snapshot.Address(), parseError(out), err)
+	}
+	return nil
+}
+
 // ListHolds will return any holds on a snapshot.
 func (z *Zed) ListHolds(ctx context.Context, snapshot Snapshot) ([]string, error) {
-	cmd := exec.CommandContext(ctx, z.path, "holds", "-H", snapshot.Address())
-	out, err := cmd.CombinedOutput()
+	holds, err := z.listHolds(ctx, []Snapshot{snapshot})
 	if err != nil {
-		return nil, fmt.Errorf("failed to list holds: %s (%w)", parseError(out), err)
+		return nil, err
 	}
 
-	holds := make([]string, 0)
-	scanner := bufio.NewScanner(strings.NewReader(string(out)))
-	for scanner.Scan() {
-		row := scanner.Text()
-		fields := strings.Split(row, "\t")
-		if len(fields) != 3 {
-			return nil, fmt.Errorf("list holds failed: error parsing row '%s'", row)
+	if v, ok := holds[snapshot.Address()]; ok {
+		return v, nil
+	}
+	return make([]string, 0), nil
+}
+
+// listHolds returns the holds for a number of snapshots keyed by snapshot address. Snapshots are passed to 'zfs holds' in
+// batches to stay within argument limits.
+func (z *Zed) listHolds(ctx context.Context, snapshots []Snapshot) (map[string][]string, error) {
+	holds := make(map[string][]string)
+
+	for begin := 0; begin < len(snapshots); begin += HoldBatch {
+		end := begin + HoldBatch
+		if end > len(snapshots) {
+			end = len(snapshots)
+		}
+
+		args := []string{"holds", "-H"}
+		for _, snapshot := range snapshots[begin:end] {
+			args = append(args, snapshot.Address())
 		}
 
-		holds = append(holds, fields[1])
+		cmd := exec.CommandContext(ctx, z.path, args...)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list holds: %s (%w)", parseError(out), err)
+		}
+
+		scanner := bufio.NewScanner(strings.NewReader(string(out)))
+		for scanner.Scan() {
+			row := scanner.Text()
+			fields := strings.Split(row, "\t")
+			if len(fields) != 3 {
+				return nil, fmt.Errorf("list holds failed: error parsing row '%s'", row)
+			}
+
+			holds[fields[0]] = append(holds[fields[0]], fields[1])
+		}
 	}
 	return holds, nil
 }
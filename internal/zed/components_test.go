@@ -0,0 +1,164 @@
+package zed
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeCommand writes a script standing in for 'zfs'. Each invocation is recorded so the number of processes can be counted.
+// The listing contains the given number of snapshots with every second snapshot held, along with a held snapshot of a
+// descendant.
+func fakeCommand(t testing.TB, snapshots int) (*Zed, func() int) {
+	dir, err := ioutil.TempDir("", "snapr")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	var listing strings.Builder
+	for i := 0; i < snapshots; i++ {
+		fmt.Fprintf(&listing, "pool-0/test@daily-%05d\t%d\t%d\t%d\t%d\n", i, 1633046400+i*3600, 1000+i, 10+i, (i+1)%2)
+		if i == 0 {
+			fmt.Fprintf(&listing, "pool-0/test/child@daily-%05d\t%d\t%d\t%d\t%d\n", i, 1633046400+i*3600, 2000+i, 10+i, 1)
+		}
+	}
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "listing"), []byte(listing.String()), 0644))
+
+	bookmarks := "pool-0/test#daily-00000\tFri Oct  1 10:00 2021\t1000\t10\npool-0/test/child#daily-00000\tFri Oct  1 10:00 2021\t2000\t10\n"
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "bookmarks"), []byte(bookmarks), 0644))
+
+	script := `#!/bin/sh
+echo "$1" >> "` + dir + `/invocations"
+case "$1" in
+list)
+	echo "$*" >> "` + dir + `/arguments"
+	case "$*" in
+	*bookmark*)
+		cat "` + dir + `/bookmarks"
+		;;
+	*)
+		cat "` + dir + `/listing"
+		;;
+	esac
+	;;
+send)
+	printf 'incremental\tdaily-00000\tpool-0/test@daily-00001\t4096\nsize\t4096\n'
+	;;
+holds)
+	shift 2
+	for snapshot in "$@"; do
+		printf '%s\tsnapr\tFri Oct  1 10:00 2021\n' "$snapshot"
+	done
+	;;
+esac
+`
+	path := filepath.Join(dir, "zfs")
+	require.NoError(t, ioutil.WriteFile(path, []byte(script), 0755))
+
+	count := func() int {
+		b, err := ioutil.ReadFile(filepath.Join(dir, "invocations"))
+		if os.IsNotExist(err) {
+			return 0
+		}
+		require.NoError(t, err)
+		return strings.Count(string(b), "\n")
+	}
+	return &Zed{path}, count
+}
+
+func TestListSnapshots(t *testing.T) {
+	z, count := fakeCommand(t, 3)
+
+	listing, err := z.ListSnapshots(context.Background(), FileSystem{"pool-0", "test"})
+	require.NoError(t, err)
+	require.Len(t, listing, 3)
+
+	assert.Equal(t, "pool-0/test@daily-00001", listing[1].Snapshot.Address())
+	assert.Equal(t, int64(1633050000), listing[1].Created.Unix())
+	assert.Equal(t, "1001", listing[1].Identity)
+	assert.Equal(t, 11, listing[1].Transaction)
+
+	assert.Equal(t, []string{"snapr"}, listing[0].Holds)
+	assert.Empty(t, listing[1].Holds)
+	assert.Equal(t, []string{"snapr"}, listing[2].Holds)
+
+	assert.Equal(t, 2, count(), "holds are listed in a single invocation")
+}
+
+func TestListDescendants(t *testing.T) {
+	z, _ := fakeCommand(t, 2)
+	fs := FileSystem{"pool-0", "test"}
+
+	// Only the file system's own snapshots and bookmarks are listed or returned.
+	listing, err := z.ListSnapshots(context.Background(), fs)
+	require.NoError(t, err)
+	require.Len(t, listing, 2)
+	for _, v := range listing {
+		assert.Equal(t, fs, v.Snapshot.Addr.FileSystem)
+	}
+
+	bookmarks, err := z.ListBookmarks(context.Background(), fs)
+	require.NoError(t, err)
+	require.Len(t, bookmarks, 1)
+	assert.Equal(t, "pool-0/test#daily-00000", bookmarks[0].Bookmark.Address())
+	assert.Equal(t, "1000", bookmarks[0].Identity)
+
+	arguments, err := ioutil.ReadFile(filepath.Join(filepath.Dir(z.path), "arguments"))
+	require.NoError(t, err)
+	for _, v := range strings.Split(strings.TrimSpace(string(arguments)), "\n") {
+		assert.Contains(t, v, " -d 1 ")
+	}
+}
+
+func TestListSnapshotsBatched(t *testing.T) {
+	// Every second snapshot is held so there are enough held snapshots to fill two batches and part of a third.
+	z, count := fakeCommand(t, 4*HoldBatch+1)
+
+	listing, err := z.ListSnapshots(context.Background(), FileSystem{"pool-0", "test"})
+	require.NoError(t, err)
+	require.Len(t, listing, 4*HoldBatch+1)
+	assert.Equal(t, []string{"snapr"}, listing[4*HoldBatch].Holds)
+
+	assert.Equal(t, 4, count())
+}
+
+func BenchmarkListSnapshots(b *testing.B) {
+	for _, snapshots := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("Batched/%d", snapshots), func(b *testing.B) {
+			z, count := fakeCommand(b, snapshots)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if _, err := z.ListSnapshots(context.Background(), FileSystem{"pool-0", "test"}); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(count())/float64(b.N), "processes/op")
+		})
+
+		// Lists holds for each snapshot individually as was done previously.
+		b.Run(fmt.Sprintf("Individual/%d", snapshots), func(b *testing.B) {
+			z, count := fakeCommand(b, snapshots)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				listing, err := z.ListSnapshots(context.Background(), FileSystem{"pool-0", "test"})
+				if err != nil {
+					b.Fatal(err)
+				}
+				for _, v := range listing {
+					if _, err := z.ListHolds(context.Background(), v.Snapshot); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+			b.ReportMetric(float64(count())/float64(b.N), "processes/op")
+		})
+	}
+}
@@ -2,14 +2,119 @@ package zed
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
 )
 
-// Receive performs a receive.
-func (z *Zed) Receive(ctx context.Context, target string, src io.Reader) error {
-	cmd := exec.CommandContext(ctx, z.path, "receive", "-d", target)
+// ErrNotExist indicates a file system does not exist.
+var ErrNotExist = errors.New("dataset does not exist")
+
+// Discard values select how the name of the received file system is formed from the sent file system.
+const (
+	// DiscardFirst removes the pool from the sent name and appends the remainder to the target ('zfs receive -d').
+	DiscardFirst = "first"
+
+	// DiscardParents appends the last element of the sent name to the target ('zfs receive -e').
+	DiscardParents = "parents"
+)
+
+var validProperty = regexp.MustCompile(`^[a-z][a-z0-9_.:-]*$`)
+
+// ReceiveOptions alter how a stream is received.
+type ReceiveOptions struct {
+	// Properties are set on the received file system ('-o').
+	Properties map[string]string
+
+	// Exclude lists properties which are not received and are inherited instead ('-x').
+	Exclude []string
+
+	// NoMount leaves the received file system unmounted ('-u').
+	NoMount bool
+
+	// Force rolls the file system back to its most recent snapshot before receiving ('-F').
+	Force bool
+
+	// Discard selects the name of the received file system. By default the target is the file system itself.
+	Discard string
+}
+
+// Validate checks the options can be passed to 'zfs receive'.
+func (o ReceiveOptions) Validate() error {
+	for name, value := range o.Properties {
+		if !validProperty.MatchString(name) {
+			return fmt.Errorf("invalid property name '%s'", name)
+		}
+		if value == "" {
+			return fmt.Errorf("no value for property '%s'", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("invalid value for property '%s'", name)
+		}
+	}
+
+	for _, name := range o.Exclude {
+		if !validProperty.MatchString(name) {
+			return fmt.Errorf("invalid property name '%s'", name)
+		}
+		if _, ok := o.Properties[name]; ok {
+			return fmt.Errorf("property '%s' cannot be both set and excluded", name)
+		}
+	}
+
+	switch o.Discard {
+	case "", DiscardFirst, DiscardParents:
+	default:
+		return fmt.Errorf("invalid discard '%s' (expected '%s' or '%s')", o.Discard, DiscardFirst, DiscardParents)
+	}
+	return nil
+}
+
+func receiveArgs(target string, options ReceiveOptions) []string {
+	args := make([]string, 0)
+
+	names := make([]string, 0, len(options.Properties))
+	for name := range options.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		args = append(args, "-o", name+"="+options.Properties[name])
+	}
+	for _, name := range options.Exclude {
+		args = append(args, "-x", name)
+	}
+
+	if options.NoMount {
+		args = append(args, "-u")
+	}
+	if options.Force {
+		args = append(args, "-F")
+	}
+
+	switch options.Discard {
+	case DiscardFirst:
+		args = append(args, "-d")
+	case DiscardParents:
+		args = append(args, "-e")
+	}
+	return append(args, target)
+}
+
+// Receive performs a receive. The target is the file system to receive into or, if a name is discarded, the file system
+// under which the received file system is created. An interrupted stream is discarded by 'zfs receive', leaving the
+// target as it was.
+func (z *Zed) Receive(ctx context.Context, target string, src io.Reader, options ReceiveOptions) error {
+	if err := options.Validate(); err != nil {
+		return fmt.Errorf("could not receive stream to '%s': %w", target, err)
+	}
+
+	cmd := exec.CommandContext(ctx, z.path, append([]string{"receive"}, receiveArgs(target, options)...)...)
 	cmd.Stdin = src
 	out, err := cmd.CombinedOutput()
 	if err != nil {
@@ -0,0 +1,34 @@
+package zed
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReceiveArgs(t *testing.T) {
+	assert.Equal(t, []string{"pool-0/test"}, receiveArgs("pool-0/test", ReceiveOptions{}))
+
+	options := ReceiveOptions{
+		Properties: map[string]string{"mountpoint": "/mnt/test", "canmount": "noauto"},
+		Exclude:    []string{"sharenfs"},
+		NoMount:    true,
+		Force:      true,
+		Discard:    DiscardFirst,
+	}
+	assert.Equal(t, []string{"-o", "canmount=noauto", "-o", "mountpoint=/mnt/test", "-x", "sharenfs", "-u", "-F", "-d", "backup"}, receiveArgs("backup", options))
+
+	options = ReceiveOptions{Discard: DiscardParents}
+	assert.Equal(t, []string{"-e", "backup"}, receiveArgs("backup", options))
+}
+
+func TestReceiveOptionsValidate(t *testing.T) {
+	assert.NoError(t, ReceiveOptions{}.Validate())
+	assert.NoError(t, ReceiveOptions{Properties: map[string]string{"snapr:test": "1"}, Exclude: []string{"mountpoint"}}.Validate())
+
+	assert.Error(t, ReceiveOptions{Properties: map[string]string{"Mount Point": "/"}}.Validate())
+	assert.Error(t, ReceiveOptions{Properties: map[string]string{"mountpoint": ""}}.Validate())
+	assert.Error(t, ReceiveOptions{Exclude: []string{"-o"}}.Validate())
+	assert.Error(t, ReceiveOptions{Properties: map[string]string{"mountpoint": "/"}, Exclude: []string{"mountpoint"}}.Validate())
+	assert.Error(t, ReceiveOptions{Discard: "all"}.Validate())
+}
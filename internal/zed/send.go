@@ -1,48 +1,65 @@
 package zed
 
 import (
+	"bufio"
 	"bytes"
 	"context"
-	"errors"
 	"fmt"
 	"io"
 	"os/exec"
-	"sync"
+	"strconv"
+	"strings"
 
 	"golang.org/x/sync/errgroup"
 )
 
 // Stream exposes a reader containing the stream and allows waiting for completion.
 type Stream struct {
-	cmd        *exec.Cmd
-	in         *io.PipeWriter
-	Out        *io.PipeReader
-	completion func(err error) error
-	error      error
-	done       bool
-	eg         *errgroup.Group
-	mu         sync.Mutex
+	Out *io.PipeReader
+	eg  *errgroup.Group
 }
 
-func (z *Zed) newStream(ctx context.Context, source *Snapshot, target Snapshot, completion func(error) error) *Stream {
+// NewStream creates a stream with content written by the producer. The completion is called with the outcome of the
+// producer once it returns.
+func NewStream(ctx context.Context, produce func(context.Context, io.Writer) error, completion func(error) error) *Stream {
 	out, in := io.Pipe()
-
 	eg, ctx := errgroup.WithContext(ctx)
 
+	eg.Go(
+		func() error {
+			defer in.Close()
+
+			cause := produce(ctx, in)
+			if cause != nil {
+				in.CloseWithError(cause)
+			}
+
+			if completion != nil {
+				if err := completion(cause); err != nil {
+					cause = fmt.Errorf("completion failed: %s (%w)", err, cause)
+				}
+			}
+			return cause
+		},
+	)
+
 	return &Stream{
-		cmd:        z.sendCmd(ctx, source, target),
-		in:         in,
-		Out:        out,
-		completion: completion,
-		eg:         eg,
+		Out: out,
+		eg:  eg,
 	}
 }
 
-func (z *Zed) sendCmd(ctx context.Context, source *Snapshot, target Snapshot) *exec.Cmd {
-	if source == nil {
-		return exec.CommandContext(ctx, z.path, "send", "--raw", "--holds", "--replicate", target.Address())
+// sendArgs forms a full send when there is no source. A replication stream cannot originate from a bookmark so a
+// bookmark source results in a plain incremental stream of the target alone, without intermediary snapshots or
+// descendants.
+func sendArgs(source Addressable, target Snapshot) []string {
+	switch source.(type) {
+	case nil:
+		return []string{"--raw", "--holds", "--replicate", target.Address()}
+	case Bookmark, *Bookmark:
+		return []string{"--raw", "--holds", "-i", source.Address(), target.Address()}
 	}
-	return exec.CommandContext(ctx, z.path, "send", "--raw", "--holds", "--replicate", "-I", source.Address(), target.Address())
+	return []string{"--raw", "--holds", "--replicate", "-I", source.Address(), target.Address()}
 }
 
 // Wait allows a client to wait for completion.
@@ -50,64 +67,55 @@ func (w *Stream) Wait() error {
 	return w.eg.Wait()
 }
 
-func (w *Stream) run() error {
-	w.mu.Lock()
-	defer w.mu.Unlock()
-
-	if w.done {
-		return errors.New("command failed: has been run previously")
-	}
-
-	w.done = true
+// Send returns a stream. The source may be a snapshot, a bookmark, or nil for a full stream.
+func (z *Zed) Send(ctx context.Context, source Addressable, target Snapshot, completion func(error) error) (*Stream, error) {
+	cmd := exec.CommandContext(ctx, z.path, append([]string{"send"}, sendArgs(source, target)...)...)
 
 	var stderr bytes.Buffer
-	w.cmd.Stderr = &stderr
+	cmd.Stderr = &stderr
 
-	stdout, err := w.cmd.StdoutPipe()
+	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	err = w.cmd.Start()
-	if err != nil {
-		return err
+	if err = cmd.Start(); err != nil {
+		return nil, err
 	}
 
-	w.eg.Go(
-		func() error {
-			defer w.in.Close()
-
-			var cause error
-
-			_, err := io.Copy(w.in, stdout)
-			if err != nil {
-				cause = fmt.Errorf("pipe failed: %w", err)
-				w.in.CloseWithError(cause)
-
-				if err := w.cmd.Process.Kill(); err != nil {
-					cause = fmt.Errorf("command termination failed: %s (%w)", err, cause)
-				}
-			} else {
-				err = w.cmd.Wait()
-				if err != nil {
-					cause = fmt.Errorf("command failed: %w", err)
-					w.in.CloseWithError(cause)
-				}
+	produce := func(ctx context.Context, w io.Writer) error {
+		if _, err := io.Copy(w, stdout); err != nil {
+			cause := fmt.Errorf("pipe failed: %w", err)
+			if err := cmd.Process.Kill(); err != nil {
+				cause = fmt.Errorf("command termination failed: %s (%w)", err, cause)
 			}
+			cmd.Wait()
+			return cause
+		}
 
-			if err := w.completion(cause); err != nil {
-				cause = fmt.Errorf("completion failed: %s (%w)", err, cause)
-			}
+		if err := cmd.Wait(); err != nil {
+			return fmt.Errorf("command failed: %s (%w)", parseError(stderr.Bytes()), err)
+		}
+		return nil
+	}
 
-			w.error = cause
-			return cause
-		},
-	)
-	return nil
+	return NewStream(ctx, produce, completion), nil
 }
 
-// Send returns a stream.
-func (z *Zed) Send(ctx context.Context, source *Snapshot, target Snapshot, completion func(error) error) (*Stream, error) {
-	stream := z.newStream(ctx, source, target, completion)
-	return stream, stream.run()
+// EstimateSend performs a dry run of a send to estimate the size of the stream in bytes.
+func (z *Zed) EstimateSend(ctx context.Context, source Addressable, target Snapshot) (int64, error) {
+	cmd := exec.CommandContext(ctx, z.path, append([]string{"send", "--dryrun", "--parsable"}, sendArgs(source, target)...)...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return 0, fmt.Errorf("failed to estimate send of '%s': %s (%w)", target.Address(), parseError(out), err)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) == 2 && fields[0] == "size" {
+			return strconv.ParseInt(fields[1], 10, 64)
+		}
+	}
+	return 0, fmt.Errorf("failed to estimate send of '%s': no size reported", target.Address())
 }
@@ -0,0 +1,30 @@
+package zed
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEstimateSend(t *testing.T) {
+	z, count := fakeCommand(t, 0)
+
+	source := Snapshot{Address{FileSystem{"pool-0", "test"}, "daily-00000"}}
+	target := Snapshot{Address{FileSystem{"pool-0", "test"}, "daily-00001"}}
+
+	size, err := z.EstimateSend(context.Background(), source, target)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4096), size)
+	assert.Equal(t, 1, count())
+}
+
+func TestSendArgs(t *testing.T) {
+	fs := FileSystem{"pool-0", "test"}
+	target := Snapshot{Address{fs, "daily-00001"}}
+
+	assert.Equal(t, []string{"--raw", "--holds", "--replicate", "pool-0/test@daily-00001"}, sendArgs(nil, target))
+	assert.Equal(t, []string{"--raw", "--holds", "--replicate", "-I", "pool-0/test@daily-00000", "pool-0/test@daily-00001"}, sendArgs(Snapshot{Address{fs, "daily-00000"}}, target))
+	assert.Equal(t, []string{"--raw", "--holds", "-i", "pool-0/test#daily-00000", "pool-0/test@daily-00001"}, sendArgs(Bookmark{Address{fs, "daily-00000"}, true}, target))
+}
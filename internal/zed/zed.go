@@ -1,15 +1,41 @@
 package zed
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"os/exec"
 	"regexp"
 )
 
 const creationTime = "Mon Jan _2 15:04 2006"
 
+// HoldBatch is the maximum number of snapshots passed to a single 'zfs holds' invocation.
+const HoldBatch = 500
+
 var sanitizer = regexp.MustCompile(`\r?\n`)
 
+// ZFS represents the operations performed on ZFS file systems. It is implemented by Zed.
+type ZFS interface {
+	ListFileSystems(ctx context.Context, fs FileSystem) ([]FileSystem, error)
+	SetProperty(ctx context.Context, fs FileSystem, domain, property, value string) error
+	GetProperty(ctx context.Context, fs FileSystem, domain, property string) (string, error)
+	ListBookmarks(ctx context.Context, fs FileSystem) ([]BookmarkListing, error)
+	CreateBookmark(ctx context.Context, bookmark Bookmark, source Snapshot) (*Bookmark, error)
+	ListSnapshots(ctx context.Context, target FileSystem) ([]SnapshotListing, error)
+	CreateSnapshot(ctx context.Context, snapshot Snapshot) error
+	CreateRecursiveSnapshot(ctx context.Context, snapshot Snapshot) error
+	CreateSnapshots(ctx context.Context, snapshots []Snapshot) error
+	HoldSnapshot(ctx context.Context, snapshot Snapshot, tag string) error
+	ReleaseSnapshot(ctx context.Context, snapshot Snapshot, tag string) error
+	ListHolds(ctx context.Context, snapshot Snapshot) ([]string, error)
+	Rollback(ctx context.Context, snapshot Snapshot) error
+	Destroy(ctx context.Context, a Addressable) error
+	Send(ctx context.Context, source Addressable, target Snapshot, completion func(error) error) (*Stream, error)
+	EstimateSend(ctx context.Context, source Addressable, target Snapshot) (int64, error)
+	Receive(ctx context.Context, target string, src io.Reader, options ReceiveOptions) error
+}
+
 // Zed exposes ZFS operations by wrapping the command-line 'zfs' utility.
 type Zed struct {
 	path string
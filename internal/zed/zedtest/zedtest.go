@@ -0,0 +1,712 @@
+// Package zedtest provides an in-memory implementation of ZFS operations for testing.
+package zedtest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"snapr/internal/zed"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Fake models datasets, snapshots, bookmarks, holds, and properties in memory. Streams produced by Send can be
+// consumed by Receive on the same or another instance.
+type Fake struct {
+	// Clock provides creation times for snapshots and bookmarks.
+	Clock func() time.Time
+
+	mu          sync.Mutex
+	transaction int
+	datasets    map[string]*dataset
+}
+
+type dataset struct {
+	name       string
+	data       []byte
+	properties map[string]string
+	snapshots  []*snapshot
+	bookmarks  []*bookmark
+	mounted    bool
+}
+
+type snapshot struct {
+	name        string
+	identity    string
+	transaction int
+	created     time.Time
+	data        []byte
+	holds       []string
+}
+
+type bookmark struct {
+	name        string
+	identity    string
+	transaction int
+	created     time.Time
+}
+
+// streamPackage is the encoding of a stream produced by Send.
+type streamPackage struct {
+	FileSystem string           `json:"fileSystem"`
+	Source     string           `json:"source"`
+	Snapshots  []streamSnapshot `json:"snapshots"`
+}
+
+type streamSnapshot struct {
+	Name     string    `json:"name"`
+	Identity string    `json:"identity"`
+	Created  time.Time `json:"created"`
+	Data     []byte    `json:"data"`
+	Holds    []string  `json:"holds"`
+}
+
+// New instantiates an empty Fake.
+func New() *Fake {
+	return &Fake{
+		Clock: func() time.Time {
+			return time.Now().UTC().Truncate(time.Second)
+		},
+		datasets: make(map[string]*dataset),
+	}
+}
+
+// CreateFileSystem creates an empty file system.
+func (f *Fake) CreateFileSystem(fs zed.FileSystem) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.datasets[fs.String()]; ok {
+		return fmt.Errorf("dataset '%s' already exists", fs)
+	}
+	f.datasets[fs.String()] = newDataset(fs.String())
+	return nil
+}
+
+// Write replaces the content of a file system.
+func (f *Fake) Write(fs zed.FileSystem, data []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	d, err := f.dataset(fs)
+	if err != nil {
+		return err
+	}
+	d.data = append([]byte(nil), data...)
+	return nil
+}
+
+// Read returns the content of a file system.
+func (f *Fake) Read(fs zed.FileSystem) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	d, err := f.dataset(fs)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), d.data...), nil
+}
+
+// Property retrieves a property set on the file system when it was received.
+func (f *Fake) Property(fs zed.FileSystem, name string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	d, ok := f.datasets[fs.String()]
+	if !ok {
+		return "", false
+	}
+	value, ok := d.properties[name]
+	return value, ok
+}
+
+// Mounted indicates whether the file system was mounted when it was received.
+func (f *Fake) Mounted(fs zed.FileSystem) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	d, ok := f.datasets[fs.String()]
+	return ok && d.mounted
+}
+
+// Exists indicates whether the file system exists.
+func (f *Fake) Exists(fs zed.FileSystem) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_, ok := f.datasets[fs.String()]
+	return ok
+}
+
+func newDataset(name string) *dataset {
+	return &dataset{
+		name:       name,
+		properties: make(map[string]string),
+		snapshots:  make([]*snapshot, 0),
+		bookmarks:  make([]*bookmark, 0),
+	}
+}
+
+func (f *Fake) dataset(fs zed.FileSystem) (*dataset, error) {
+	d, ok := f.datasets[fs.String()]
+	if !ok {
+		return nil, fmt.Errorf("dataset '%s' does not exist", fs)
+	}
+	return d, nil
+}
+
+func (f *Fake) snapshot(s zed.Snapshot) (*dataset, *snapshot, error) {
+	d, err := f.dataset(s.Addr.FileSystem)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, v := range d.snapshots {
+		if v.name == s.Addr.Name {
+			return d, v, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("snapshot '%s' does not exist", s.Address())
+}
+
+// identities is shared by every Fake so GUIDs are unique across hosts as they are with ZFS.
+var identities uint64 = 1000
+
+func (f *Fake) nextIdentity() string {
+	return strconv.FormatUint(atomic.AddUint64(&identities, 7919), 10)
+}
+
+// ListFileSystems lists a file system and all of its descendants.
+func (f *Fake) ListFileSystems(ctx context.Context, fs zed.FileSystem) ([]zed.FileSystem, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, err := f.dataset(fs); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0)
+	for name := range f.datasets {
+		if name == fs.String() || strings.HasPrefix(name, fs.String()+"/") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	listing := make([]zed.FileSystem, 0, len(names))
+	for _, name := range names {
+		child, err := zed.ToFileSystem(name)
+		if err != nil {
+			return nil, err
+		}
+		listing = append(listing, *child)
+	}
+	return listing, nil
+}
+
+// SetProperty sets a user property on the file system.
+func (f *Fake) SetProperty(ctx context.Context, fs zed.FileSystem, domain, property, value string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	d, err := f.dataset(fs)
+	if err != nil {
+		return err
+	}
+	d.properties[domain+":"+property] = value
+	return nil
+}
+
+// GetProperty retrieves a user property from the file system or an empty string if it is not set.
+func (f *Fake) GetProperty(ctx context.Context, fs zed.FileSystem, domain, property string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	d, err := f.dataset(fs)
+	if err != nil {
+		return "", err
+	}
+	return d.properties[domain+":"+property], nil
+}
+
+// ListBookmarks lists the bookmarks of a file system.
+func (f *Fake) ListBookmarks(ctx context.Context, fs zed.FileSystem) ([]zed.BookmarkListing, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	d, err := f.dataset(fs)
+	if err != nil {
+		return nil, err
+	}
+
+	listing := make([]zed.BookmarkListing, 0, len(d.bookmarks))
+	for _, v := range d.bookmarks {
+		listing = append(listing, zed.BookmarkListing{
+			Bookmark:    zed.Bookmark{Addr: zed.Address{FileSystem: fs, Name: v.name}, Exists: true},
+			Created:     v.created,
+			Identity:    v.identity,
+			Transaction: v.transaction,
+		})
+	}
+	return listing, nil
+}
+
+// CreateBookmark bookmarks a snapshot.
+func (f *Fake) CreateBookmark(ctx context.Context, b zed.Bookmark, source zed.Snapshot) (*zed.Bookmark, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	d, s, err := f.snapshot(source)
+	if err != nil {
+		return nil, err
+	}
+
+	if b.Addr.FileSystem != source.Addr.FileSystem {
+		return nil, fmt.Errorf("bookmark '%s' must be in the same file system as '%s'", b.Address(), source.Address())
+	}
+
+	for _, v := range d.bookmarks {
+		if v.name == b.Addr.Name {
+			return nil, fmt.Errorf("bookmark '%s' already exists", b.Address())
+		}
+	}
+
+	d.bookmarks = append(d.bookmarks, &bookmark{b.Addr.Name, s.identity, s.transaction, s.created})
+	b.Exists = true
+	return &b, nil
+}
+
+// ListSnapshots lists the snapshots of a file system ordered by creation.
+func (f *Fake) ListSnapshots(ctx context.Context, fs zed.FileSystem) ([]zed.SnapshotListing, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	d, ok := f.datasets[fs.String()]
+	if !ok {
+		return nil, zed.ErrNotExist
+	}
+
+	listing := make([]zed.SnapshotListing, 0, len(d.snapshots))
+	for _, v := range d.snapshots {
+		listing = append(listing, zed.SnapshotListing{
+			Snapshot:    zed.Snapshot{Addr: zed.Address{FileSystem: fs, Name: v.name}},
+			Created:     v.created,
+			Identity:    v.identity,
+			Transaction: v.transaction,
+			Holds:       append([]string{}, v.holds...),
+		})
+	}
+	return listing, nil
+}
+
+// CreateSnapshot creates a snapshot.
+func (f *Fake) CreateSnapshot(ctx context.Context, s zed.Snapshot) error {
+	return f.CreateSnapshots(ctx, []zed.Snapshot{s})
+}
+
+// CreateRecursiveSnapshot creates a snapshot of a file system and its descendants.
+func (f *Fake) CreateRecursiveSnapshot(ctx context.Context, s zed.Snapshot) error {
+	children, err := f.ListFileSystems(ctx, s.Addr.FileSystem)
+	if err != nil {
+		return err
+	}
+
+	snapshots := make([]zed.Snapshot, 0, len(children))
+	for _, child := range children {
+		snapshots = append(snapshots, zed.Snapshot{Addr: zed.Address{FileSystem: child, Name: s.Addr.Name}})
+	}
+	return f.CreateSnapshots(ctx, snapshots)
+}
+
+// CreateSnapshots atomically creates snapshots within a single transaction.
+func (f *Fake) CreateSnapshots(ctx context.Context, snapshots []zed.Snapshot) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, s := range snapshots {
+		if _, _, err := f.snapshot(s); err == nil {
+			return fmt.Errorf("snapshot '%s' already exists", s.Address())
+		}
+		if _, err := f.dataset(s.Addr.FileSystem); err != nil {
+			return err
+		}
+	}
+
+	f.transaction++
+	created := f.Clock()
+	for _, s := range snapshots {
+		d := f.datasets[s.Addr.FileSystem.String()]
+		d.snapshots = append(d.snapshots, &snapshot{
+			name:        s.Addr.Name,
+			identity:    f.nextIdentity(),
+			transaction: f.transaction,
+			created:     created,
+			data:        append([]byte(nil), d.data...),
+			holds:       make([]string, 0),
+		})
+	}
+	return nil
+}
+
+// HoldSnapshot places a hold on a snapshot.
+func (f *Fake) HoldSnapshot(ctx context.Context, s zed.Snapshot, tag string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_, v, err := f.snapshot(s)
+	if err != nil {
+		return err
+	}
+
+	for _, hold := range v.holds {
+		if hold == tag {
+			return fmt.Errorf("tag '%s' already exists on '%s'", tag, s.Address())
+		}
+	}
+	v.holds = append(v.holds, tag)
+	return nil
+}
+
+// ReleaseSnapshot releases a hold on a snapshot.
+func (f *Fake) ReleaseSnapshot(ctx context.Context, s zed.Snapshot, tag string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_, v, err := f.snapshot(s)
+	if err != nil {
+		return err
+	}
+
+	for i, hold := range v.holds {
+		if hold == tag {
+			v.holds = append(v.holds[:i], v.holds[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+// ListHolds lists the holds on a snapshot.
+func (f *Fake) ListHolds(ctx context.Context, s zed.Snapshot) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_, v, err := f.snapshot(s)
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{}, v.holds...), nil
+}
+
+// Rollback reverts the data of a file system to a snapshot and destroys later snapshots, mirroring 'zfs rollback -r'.
+func (f *Fake) Rollback(ctx context.Context, s zed.Snapshot) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	d, v, err := f.snapshot(s)
+	if err != nil {
+		return err
+	}
+
+	for i, later := range d.snapshots {
+		if later != v {
+			continue
+		}
+
+		for _, w := range d.snapshots[i+1:] {
+			if len(w.holds) > 0 {
+				return fmt.Errorf("failed to roll back to '%s': snapshot '%s' is busy", s.Address(), w.name)
+			}
+		}
+		d.snapshots = d.snapshots[:i+1]
+		break
+	}
+
+	d.data = append([]byte{}, v.data...)
+	return nil
+}
+
+// Destroy destroys a snapshot, bookmark, or file system.
+func (f *Fake) Destroy(ctx context.Context, a zed.Addressable) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	address := a.Address()
+	switch {
+	case strings.Contains(address, "@"):
+		addr, err := zed.NewAddress(address, "@")
+		if err != nil {
+			return err
+		}
+
+		d, v, err := f.snapshot(zed.Snapshot{Addr: *addr})
+		if err != nil {
+			return err
+		}
+
+		if len(v.holds) > 0 {
+			return fmt.Errorf("failed to destroy '%s': dataset is busy", address)
+		}
+
+		for i, s := range d.snapshots {
+			if s == v {
+				d.snapshots = append(d.snapshots[:i], d.snapshots[i+1:]...)
+				break
+			}
+		}
+	case strings.Contains(address, "#"):
+		addr, err := zed.NewAddress(address, "#")
+		if err != nil {
+			return err
+		}
+
+		d, err := f.dataset(addr.FileSystem)
+		if err != nil {
+			return err
+		}
+
+		for i, b := range d.bookmarks {
+			if b.name == addr.Name {
+				d.bookmarks = append(d.bookmarks[:i], d.bookmarks[i+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("bookmark '%s' does not exist", address)
+	default:
+		fs, err := zed.ToFileSystem(address)
+		if err != nil {
+			return err
+		}
+
+		d, err := f.dataset(*fs)
+		if err != nil {
+			return err
+		}
+
+		if len(d.snapshots) > 0 {
+			return fmt.Errorf("failed to destroy '%s': filesystem has children", address)
+		}
+		delete(f.datasets, address)
+	}
+	return nil
+}
+
+// Send produces a stream package. A full stream includes all snapshots up to the target, an incremental stream from
+// a snapshot includes all intermediary snapshots, and an incremental stream from a bookmark includes only the target.
+func (f *Fake) Send(ctx context.Context, source zed.Addressable, target zed.Snapshot, completion func(error) error) (*zed.Stream, error) {
+	pkg, err := f.pack(source, target)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(pkg)
+	if err != nil {
+		return nil, err
+	}
+
+	produce := func(ctx context.Context, w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	}
+	return zed.NewStream(ctx, produce, completion), nil
+}
+
+// EstimateSend reports the size of the stream package which would be produced.
+func (f *Fake) EstimateSend(ctx context.Context, source zed.Addressable, target zed.Snapshot) (int64, error) {
+	pkg, err := f.pack(source, target)
+	if err != nil {
+		return 0, err
+	}
+
+	data, err := json.Marshal(pkg)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(data)), nil
+}
+
+func (f *Fake) pack(source zed.Addressable, target zed.Snapshot) (*streamPackage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	d, t, err := f.snapshot(target)
+	if err != nil {
+		return nil, err
+	}
+
+	pkg := &streamPackage{FileSystem: target.Addr.FileSystem.String()}
+	first := 0
+
+	switch v := source.(type) {
+	case nil:
+	case zed.Bookmark:
+		b, err := f.bookmark(d, v)
+		if err != nil {
+			return nil, err
+		}
+		if b.transaction >= t.transaction {
+			return nil, fmt.Errorf("bookmark '%s' is not earlier than '%s'", v.Address(), target.Address())
+		}
+		pkg.Source = b.identity
+		first = len(d.snapshots)
+		for i, s := range d.snapshots {
+			if s == t {
+				first = i
+			}
+		}
+	case zed.Snapshot:
+		_, s, err := f.snapshot(v)
+		if err != nil {
+			return nil, err
+		}
+		if s.transaction >= t.transaction {
+			return nil, fmt.Errorf("snapshot '%s' is not earlier than '%s'", v.Address(), target.Address())
+		}
+		pkg.Source = s.identity
+		for i, candidate := range d.snapshots {
+			if candidate == s {
+				first = i + 1
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported source '%s'", source.Address())
+	}
+
+	for _, s := range d.snapshots[first:] {
+		if s.transaction > t.transaction {
+			break
+		}
+		pkg.Snapshots = append(pkg.Snapshots, streamSnapshot{s.name, s.identity, s.created, s.data, s.holds})
+	}
+	return pkg, nil
+}
+
+func (f *Fake) bookmark(d *dataset, b zed.Bookmark) (*bookmark, error) {
+	for _, v := range d.bookmarks {
+		if v.name == b.Addr.Name {
+			return v, nil
+		}
+	}
+	return nil, fmt.Errorf("bookmark '%s' does not exist", b.Address())
+}
+
+// Receive consumes a stream package, mirroring 'zfs receive'. The received file system is named according to the discard
+// option. A stream which fails part way is discarded. Received properties are recorded and the file system is mounted
+// unless NoMount is set.
+func (f *Fake) Receive(ctx context.Context, target string, src io.Reader, options zed.ReceiveOptions) error {
+	if err := options.Validate(); err != nil {
+		return fmt.Errorf("could not receive stream to '%s': %w", target, err)
+	}
+
+	raw, err := ioutil.ReadAll(src)
+	if err != nil {
+		return err
+	}
+
+	var pkg streamPackage
+	if err := json.Unmarshal(raw, &pkg); err != nil {
+		return fmt.Errorf("could not receive stream to '%s': invalid stream (%w)", target, err)
+	}
+
+	fs, err := receiveTarget(target, pkg.FileSystem, options.Discard)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	d, ok := f.datasets[fs.String()]
+
+	if pkg.Source == "" {
+		if ok {
+			return fmt.Errorf("could not receive stream to '%s': destination exists", fs)
+		}
+		d = newDataset(fs.String())
+		f.datasets[fs.String()] = d
+	} else {
+		if !ok {
+			return fmt.Errorf("could not receive stream to '%s': destination does not exist", fs)
+		}
+		if err := f.rollbackTo(d, pkg.Source, options.Force); err != nil {
+			return fmt.Errorf("could not receive stream to '%s': %w", fs, err)
+		}
+	}
+
+	for _, s := range pkg.Snapshots {
+		for _, v := range d.snapshots {
+			if v.name == s.Name {
+				return fmt.Errorf("could not receive stream to '%s': snapshot '%s' exists", fs, s.Name)
+			}
+		}
+	}
+
+	for _, s := range pkg.Snapshots {
+		f.transaction++
+		d.snapshots = append(d.snapshots, &snapshot{s.Name, s.Identity, f.transaction, s.Created, s.Data, append([]string{}, s.Holds...)})
+		d.data = append([]byte(nil), s.Data...)
+	}
+
+	for name, value := range options.Properties {
+		d.properties[name] = value
+	}
+	for _, name := range options.Exclude {
+		delete(d.properties, name)
+	}
+	d.mounted = !options.NoMount
+	return nil
+}
+
+// rollbackTo checks the most recent snapshot is the incremental source. If forced, later snapshots are destroyed to make
+// the source the most recent.
+func (f *Fake) rollbackTo(d *dataset, source string, force bool) error {
+	for i := len(d.snapshots) - 1; i >= 0; i-- {
+		if d.snapshots[i].identity != source {
+			continue
+		}
+
+		if i == len(d.snapshots)-1 {
+			return nil
+		}
+
+		if !force {
+			break
+		}
+
+		for _, v := range d.snapshots[i+1:] {
+			if len(v.holds) > 0 {
+				return fmt.Errorf("snapshot '%s' is busy", v.name)
+			}
+		}
+		d.snapshots = d.snapshots[:i+1]
+		d.data = append([]byte(nil), d.snapshots[i].data...)
+		return nil
+	}
+	return fmt.Errorf("most recent snapshot does not match incremental source")
+}
+
+// receiveTarget determines the file system a stream is received into.
+func receiveTarget(target, origin, discard string) (*zed.FileSystem, error) {
+	fs, err := zed.ToFileSystem(origin)
+	if err != nil {
+		return nil, err
+	}
+
+	switch discard {
+	case zed.DiscardFirst:
+		return zed.ToFileSystem(target + "/" + fs.Name)
+	case zed.DiscardParents:
+		elements := strings.Split(fs.Name, "/")
+		return zed.ToFileSystem(target + "/" + elements[len(elements)-1])
+	}
+	return zed.ToFileSystem(target)
+}
+
+var _ zed.ZFS = (*Fake)(nil)